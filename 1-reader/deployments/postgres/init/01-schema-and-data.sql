@@ -30,7 +30,8 @@ INSERT INTO compliance_results (baseline_id,device_id,compliance_status,drift_co
 INSERT INTO users (username,email,full_name,role) VALUES ('admin','admin@corp.local','Admin','Administrator'),('jsmith','js@corp.local','John Smith','DeviceManager'),('mj','mj@corp.local','Muralidhar J','Administrator'),('venkat','vd@corp.local','Venkat D','Administrator'),('viewer','v@corp.local','Viewer','Viewer');
 INSERT INTO job_history (job_name,job_type,status,target_count,success_count,failure_count,started_at,completed_at,created_by) SELECT CASE (i%5) WHEN 0 THEN 'Discovery' WHEN 1 THEN 'Inventory' WHEN 2 THEN 'HealthCheck' WHEN 3 THEN 'FirmwareUpdate' ELSE 'ComplianceCheck' END||'-'||i, CASE (i%5) WHEN 0 THEN 'Discovery' WHEN 1 THEN 'Inventory' WHEN 2 THEN 'HealthCheck' WHEN 3 THEN 'FirmwareUpdate' ELSE 'ComplianceCheck' END, CASE (i%8) WHEN 0 THEN 'Failed' ELSE 'Completed' END, (random()*200+10)::INT,(random()*200)::INT,(random()*5)::INT, NOW()-(i*4||' hours')::INTERVAL, NOW()-((i*4-1)||' hours')::INTERVAL, CASE (i%3) WHEN 0 THEN 'admin' WHEN 1 THEN 'jsmith' ELSE 'mj' END FROM generate_series(1,100) AS i;
 
--- captures ALL tables:
+-- captures ALL tables; the writer narrows it to its table list at bootstrap
+-- (3-writer/publication.go):
 CREATE PUBLICATION dbz_publication FOR ALL TABLES;
 
 -- Do this (only specific tables):
@@ -0,0 +1,172 @@
+// catalog.go — Table schema lookup from a PostgreSQL catalog.
+// Sinks that create their own target tables read column definitions and
+// primary keys from the source database through these helpers. Each table is
+// looked up on the first source that replicates it (see catalogFor).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// catalogDBs caches one connection pool per source site for catalog reads.
+var (
+	catalogDBs   = make(map[string]*sql.DB)
+	catalogDBsMu sync.Mutex
+)
+
+// catalogFor returns the catalog pool of the first source that replicates
+// table, so tables only some sources publish are found where they exist.
+func catalogFor(table string) (*sql.DB, error) {
+	src := sources[0]
+	for _, s := range sources {
+		if contains(s.tableList(), table) {
+			src = s
+			break
+		}
+	}
+	catalogDBsMu.Lock()
+	defer catalogDBsMu.Unlock()
+	if db, ok := catalogDBs[src.Site]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return nil, err
+	}
+	catalogDBs[src.Site] = db
+	return db, nil
+}
+
+// sourceKeys caches the primary key of every source table.
+var (
+	sourceKeys   = make(map[string][]string)
+	sourceKeysMu sync.Mutex
+)
+
+// sourceKey returns the primary key columns of a source table from the
+// catalog, falling back to "id" for tables without one and, uncached, while
+// the catalog cannot be read.
+func sourceKey(table string) []string {
+	sourceKeysMu.Lock()
+	key, ok := sourceKeys[table]
+	sourceKeysMu.Unlock()
+	if ok {
+		return key
+	}
+	key, err := catalogKey(table)
+	if err != nil {
+		log.Printf("  [catalog] %s primary key: %v; assuming id", table, err)
+		return []string{"id"}
+	}
+	if len(key) == 0 {
+		log.Printf("  [catalog] %s has no primary key; assuming id", table)
+		key = []string{"id"}
+	}
+	sourceKeysMu.Lock()
+	sourceKeys[table] = key
+	sourceKeysMu.Unlock()
+	return key
+}
+
+// catalogKey reads the primary key columns of a source table from the
+// catalog, empty for tables without one.
+func catalogKey(table string) ([]string, error) {
+	db, err := catalogFor(table)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := loadTableSchema(context.Background(), db, "public", table)
+	return ts.Key, err
+}
+
+// closeCatalogs closes the catalog pools.
+func closeCatalogs() {
+	catalogDBsMu.Lock()
+	defer catalogDBsMu.Unlock()
+	for site, db := range catalogDBs {
+		db.Close()
+		delete(catalogDBs, site)
+	}
+}
+
+// column is one column of a table as reported by pg_attribute.
+type column struct {
+	Name    string
+	Type    string // format_type() output, e.g. "character varying(20)"
+	NotNull bool
+}
+
+// tableSchema is the column list and primary key of a table.
+type tableSchema struct {
+	Name    string
+	Columns []column
+	Key     []string // primary key columns in key order
+}
+
+// loadTableSchema reads the columns and primary key of schema.table.
+func loadTableSchema(ctx context.Context, db *sql.DB, schema, table string) (tableSchema, error) {
+	ts := tableSchema{Name: table}
+	rel := quoteIdent(schema) + "." + quoteIdent(table)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, rel)
+	if err != nil {
+		return ts, err
+	}
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull); err != nil {
+			rows.Close()
+			return ts, err
+		}
+		ts.Columns = append(ts.Columns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ts, err
+	}
+	if len(ts.Columns) == 0 {
+		return ts, fmt.Errorf("table %s not found", rel)
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = to_regclass($1) AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum)`, rel)
+	if err != nil {
+		return ts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return ts, err
+		}
+		ts.Key = append(ts.Key, k)
+	}
+	return ts, rows.Err()
+}
+
+// quoteIdent double-quotes an SQL identifier. Works for PostgreSQL and SQLite.
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteIdents quotes and comma-joins a list of identifiers.
+func quoteIdents(names []string) string {
+	q := make([]string, len(names))
+	for i, n := range names {
+		q[i] = quoteIdent(n)
+	}
+	return strings.Join(q, ",")
+}
@@ -0,0 +1,324 @@
+// conflict.go — Conflict detection and resolution for active-active failback.
+// With failback on, a row can be edited on postgres1 and postgres2 at the
+// same time. Before a change is applied in either direction the target row
+// is locked and compared with the change's before image (REPLICA IDENTITY
+// FULL, set by setupFailback): a column whose target value differs from the
+// before image was changed on the target meanwhile. Columns changed on one
+// side only are merged; columns changed on both sides are resolved by the
+// table's conflictPolicy:
+//
+//	lww              the later commit wins: the change's source ts_ms against
+//	                 the target row's commit timestamp (track_commit_timestamp)
+//	source_wins      postgres1's value wins, whichever side the change is from
+//	federation_wins  postgres2's value wins
+//	max, min         GREATEST / LEAST of both values
+//	or, and          boolean OR / AND of both values
+//
+// Target values are compared with the images cast to the target column types.
+// Inserts are only locked for tables with a conflictPolicy; without one an
+// insert racing a target-side insert falls to the upsert's ON CONFLICT.
+//
+// Row-level conflicts (a delete against a changed row, an insert against an
+// existing one, an update of a row deleted on the target) use the table
+// rule, Resolve. An update of a deleted row under lww keeps it deleted: the
+// deletion time is unknown. Every conflict is recorded in _cdc_conflicts of
+// the database the change was applied to, in the same transaction.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// conflictPolicy configures how a table's conflicts are resolved.
+type conflictPolicy struct {
+	Resolve string            // table rule: lww (default), source_wins, federation_wins
+	Columns map[string]string // per-column rule, any rule listed above
+}
+
+// conflictsDDL creates the conflict audit table.
+const conflictsDDL = `CREATE TABLE IF NOT EXISTS _cdc_conflicts (
+	id BIGSERIAL PRIMARY KEY, detected_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	origin TEXT NOT NULL, table_name TEXT NOT NULL, row_key JSONB NOT NULL,
+	kind TEXT NOT NULL, columns TEXT[] NOT NULL, resolution TEXT NOT NULL,
+	incoming JSONB, source_ts TIMESTAMPTZ, target_commit_ts TIMESTAMPTZ)`
+
+// mergeExprs are the rules that combine both values in SQL; _t is the
+// target row and EXCLUDED the incoming one in the upsert.
+var mergeExprs = map[string]string{
+	"max": "GREATEST(_t.%[1]s, EXCLUDED.%[1]s)",
+	"min": "LEAST(_t.%[1]s, EXCLUDED.%[1]s)",
+	"or":  "(_t.%[1]s OR EXCLUDED.%[1]s)",
+	"and": "(_t.%[1]s AND EXCLUDED.%[1]s)",
+}
+
+// conflictChecked reports whether changes of the event's table can conflict,
+// i.e. the table flows in both directions.
+func conflictChecked(e changeEvent) bool {
+	return failbackEnabled && !multiSource() && !isMapped(e.Table)
+}
+
+// commitTimestamps reports whether the database records commit timestamps,
+// which lww needs to date the target row.
+func commitTimestamps(db *sql.DB) bool {
+	var on bool
+	db.QueryRow("SELECT current_setting('track_commit_timestamp') = 'on'").Scan(&on)
+	if !on {
+		log.Println("  [conflict] track_commit_timestamp is off: lww lets incoming changes win")
+	}
+	return on
+}
+
+// resolveConflict locks the event's target row, detects a conflict and
+// returns the event to apply: unchanged, with target-side columns removed
+// from After and merge expressions set, or apply=false when the target side
+// wins the whole row. commitTs tells whether commit timestamps are available.
+func resolveConflict(ctx context.Context, tx *sql.Tx, e changeEvent, commitTs bool) (changeEvent, bool, error) {
+	if e.Op == "u" && e.Before == nil {
+		return e, true, nil // no before image, nothing to compare against
+	}
+	cfg := configFor(e.Table)
+	types, err := targetColumnTypes(ctx, tx, e)
+	if err != nil {
+		return e, false, err
+	}
+	var cols []string
+	for c, v := range e.row() {
+		if _, masked := cfg.Mask[c]; masked || contains(e.Key, c) || writerColumn(c) || !keepsColumn(e.Table, c) || !scalar(v) || types[c] == "" {
+			continue
+		}
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+
+	// Per column: target differs from the before image, from the after image.
+	where, args := keyWhere(e.Key, e.row(), 1)
+	sel := []string{"NULL::timestamptz"}
+	if commitTs {
+		sel[0] = "pg_xact_commit_timestamp(_t.xmin)"
+	}
+	distinct := func(img map[string]interface{}, c string) string {
+		v, ok := img[c]
+		if !ok || img == nil {
+			return "false"
+		}
+		if temporalType(types[c]) {
+			v = convertTimestamp(v)
+		}
+		args = append(args, v)
+		return fmt.Sprintf("_t.%s IS DISTINCT FROM $%d::%s", quoteIdent(c), len(args), types[c])
+	}
+	for _, c := range cols {
+		sel = append(sel, distinct(e.Before, c), distinct(e.After, c))
+	}
+	lock := ""
+	if e.Op == "u" || e.Op == "d" || cfg.Conflict.Resolve != "" || len(cfg.Conflict.Columns) > 0 {
+		lock = " FOR UPDATE"
+	}
+	q := fmt.Sprintf("SELECT %s FROM %s _t WHERE %s%s", strings.Join(sel, ","), qualifiedTarget(e), where, lock)
+	var targetTs sql.NullTime
+	flags := make([]bool, 2*len(cols))
+	dest := []interface{}{&targetTs}
+	for i := range flags {
+		dest = append(dest, &flags[i])
+	}
+	err = tx.QueryRowContext(ctx, q, args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		if e.Op != "u" {
+			return e, true, nil
+		}
+		// Updated on one side, deleted on the other. Under lww the deletion
+		// time is unknown, so the row stays deleted.
+		rule, win := cfg.Conflict.Resolve, false
+		if rule == "source_wins" || rule == "federation_wins" {
+			win = incomingWins(rule, e, targetTs)
+		}
+		return e, win, recordConflict(ctx, tx, e, "update_missing", nil, resolution(win, rule), targetTs)
+	}
+	if err != nil {
+		return e, false, err
+	}
+
+	changedBoth, changedTarget := classifyConflict(e, cols, flags)
+	if len(changedBoth) == 0 && len(changedTarget) == 0 {
+		return e, true, nil
+	}
+
+	if e.Op == "d" {
+		win := incomingWins(cfg.Conflict.Resolve, e, targetTs)
+		return e, win, recordConflict(ctx, tx, e, "delete_changed", changedTarget, resolution(win, cfg.Conflict.Resolve), targetTs)
+	}
+
+	kind := "update_update"
+	if e.Op != "u" {
+		kind = "insert_exists"
+	}
+	after := make(map[string]interface{}, len(e.After))
+	for k, v := range e.After {
+		after[k] = v
+	}
+	var res []string
+	for _, c := range changedTarget {
+		delete(after, c)
+		res = append(res, c+"=kept")
+	}
+	for _, c := range changedBoth {
+		rule := cfg.Conflict.Columns[c]
+		if rule == "" {
+			rule = cfg.Conflict.Resolve
+		}
+		if expr, ok := mergeExprs[rule]; ok {
+			if e.Merge == nil {
+				e.Merge = make(map[string]string)
+			}
+			e.Merge[c] = fmt.Sprintf(expr, quoteIdent(c))
+			res = append(res, c+"="+rule)
+			continue
+		}
+		win := incomingWins(rule, e, targetTs)
+		if !win {
+			delete(after, c)
+		}
+		res = append(res, c+"="+resolution(win, rule))
+	}
+	e.After = after
+	return e, true, recordConflict(ctx, tx, e, kind, append(changedBoth, changedTarget...), strings.Join(res, ","), targetTs)
+}
+
+// classifyConflict splits the compared columns of a change into those
+// changed on both sides and those changed on the target only. flags holds,
+// per column, whether the target value differs from the before image and
+// from the after image.
+func classifyConflict(e changeEvent, cols []string, flags []bool) (changedBoth, changedTarget []string) {
+	for i, c := range cols {
+		divergedBefore, differsAfter := flags[2*i], flags[2*i+1]
+		switch e.Op {
+		case "c", "r":
+			if differsAfter {
+				changedBoth = append(changedBoth, c)
+			}
+		case "u":
+			changed := !reflect.DeepEqual(e.Before[c], e.After[c])
+			if divergedBefore && changed && differsAfter {
+				changedBoth = append(changedBoth, c)
+			} else if divergedBefore && !changed {
+				changedTarget = append(changedTarget, c)
+			}
+		case "d":
+			if divergedBefore {
+				changedTarget = append(changedTarget, c)
+			}
+		}
+	}
+	return changedBoth, changedTarget
+}
+
+var (
+	columnTypes   = make(map[string]map[string]string) // schema.table → column → type
+	columnTypesMu sync.Mutex
+)
+
+// targetColumnTypes returns the column types (format_type) of the event's
+// target, read through tx on first use. Conflict-checked tables are unmapped
+// and restored from the source, so both databases agree on them.
+func targetColumnTypes(ctx context.Context, tx *sql.Tx, e changeEvent) (map[string]string, error) {
+	rel := qualifiedTarget(e)
+	columnTypesMu.Lock()
+	types, ok := columnTypes[rel]
+	columnTypesMu.Unlock()
+	if ok {
+		return types, nil
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT attname, format_type(atttypid, atttypmod) FROM pg_attribute
+		WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types = make(map[string]string)
+	for rows.Next() {
+		var c, t string
+		if err := rows.Scan(&c, &t); err != nil {
+			return nil, err
+		}
+		types[c] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(types) > 0 {
+		columnTypesMu.Lock()
+		columnTypes[rel] = types
+		columnTypesMu.Unlock()
+	}
+	return types, nil
+}
+
+// temporalType reports whether a format_type name is a date or timestamp,
+// whose Debezium values may need convertTimestamp.
+func temporalType(t string) bool {
+	return t == "date" || strings.HasPrefix(t, "timestamp")
+}
+
+// incomingWins decides a conflict under rule (lww when empty).
+func incomingWins(rule string, e changeEvent, targetTs sql.NullTime) bool {
+	fromSource := e.Site != failback.Site
+	switch rule {
+	case "source_wins":
+		return fromSource
+	case "federation_wins":
+		return !fromSource
+	}
+	if !targetTs.Valid || e.TsMs == 0 {
+		return true
+	}
+	return time.UnixMilli(e.TsMs).After(targetTs.Time)
+}
+
+// resolution renders a decision for the audit table.
+func resolution(incoming bool, rule string) string {
+	if rule == "" {
+		rule = "lww"
+	}
+	if incoming {
+		return rule + ":incoming"
+	}
+	return rule + ":target"
+}
+
+// recordConflict writes one detected conflict to _cdc_conflicts.
+func recordConflict(ctx context.Context, tx *sql.Tx, e changeEvent, kind string, cols []string, res string, targetTs sql.NullTime) error {
+	key, _ := json.Marshal(keyValues(e.Key, e.row()))
+	incoming, _ := json.Marshal(e.row())
+	log.Printf("  [conflict] %s %s id=%s from %s: %s", kind, e.Target, key, e.Site, res)
+	_, err := tx.ExecContext(ctx, `INSERT INTO _cdc_conflicts
+		(origin, table_name, row_key, kind, columns, resolution, incoming, source_ts, target_commit_ts)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`,
+		e.Site, e.Target, string(key), kind, pq.Array(cols), res, string(incoming), sourceTime(e.TsMs), targetTs)
+	return err
+}
+
+// writerColumn reports whether a column is added by the writer on postgres2
+// rather than replicated from the source.
+func writerColumn(c string) bool {
+	return strings.HasPrefix(c, "_cdc_") || strings.HasPrefix(c, "_deleted") || c == siteColumn
+}
+
+// scalar reports whether a JSON value can be compared as a query parameter.
+func scalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+// conflict_test.go — Tests for conflict classification and resolution rules.
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClassifyConflict(t *testing.T) {
+	before := map[string]interface{}{"id": float64(1), "name": "a", "status": "OK"}
+	renamed := map[string]interface{}{"id": float64(1), "name": "b", "status": "OK"}
+	cols := []string{"name", "status"}
+
+	tests := []struct {
+		name          string
+		op            string
+		before, after map[string]interface{}
+		flags         []bool // per column: target differs from before, from after
+		wantBoth      []string
+		wantTarget    []string
+	}{
+		{"update, target untouched", "u", before, renamed,
+			[]bool{false, true, false, false}, nil, nil},
+		{"update, same column changed on target", "u", before, renamed,
+			[]bool{true, true, false, false}, []string{"name"}, nil},
+		{"update, target already holds the new value", "u", before, renamed,
+			[]bool{true, false, false, false}, nil, nil},
+		{"update, other column changed on target", "u", before, renamed,
+			[]bool{false, true, true, true}, nil, []string{"status"}},
+		{"insert over identical row", "c", nil, before,
+			[]bool{false, false, false, false}, nil, nil},
+		{"insert over different row", "c", nil, before,
+			[]bool{false, true, false, false}, []string{"name"}, nil},
+		{"snapshot read over different row", "r", nil, before,
+			[]bool{false, false, false, true}, []string{"status"}, nil},
+		{"delete of unchanged row", "d", before, nil,
+			[]bool{false, false, false, false}, nil, nil},
+		{"delete of changed row", "d", before, nil,
+			[]bool{true, false, false, false}, nil, []string{"name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := changeEvent{Op: tt.op, Before: tt.before, After: tt.after}
+			both, target := classifyConflict(e, cols, tt.flags)
+			if !reflect.DeepEqual(both, tt.wantBoth) || !reflect.DeepEqual(target, tt.wantTarget) {
+				t.Errorf("got both=%v target=%v, want both=%v target=%v", both, target, tt.wantBoth, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestIncomingWins(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	targetTs := sql.NullTime{Time: at, Valid: true}
+	fromSource := changeEvent{Site: sources[0].Site, TsMs: at.Add(-time.Second).UnixMilli()}
+	fromFederation := changeEvent{Site: failback.Site, TsMs: at.Add(time.Second).UnixMilli()}
+
+	tests := []struct {
+		name     string
+		rule     string
+		e        changeEvent
+		targetTs sql.NullTime
+		want     bool
+	}{
+		{"lww older incoming", "", fromSource, targetTs, false},
+		{"lww newer incoming", "lww", fromFederation, targetTs, true},
+		{"lww without commit timestamp", "", fromSource, sql.NullTime{}, true},
+		{"lww without source time", "", changeEvent{Site: sources[0].Site}, targetTs, true},
+		{"source_wins from source", "source_wins", fromSource, targetTs, true},
+		{"source_wins from federation", "source_wins", fromFederation, targetTs, false},
+		{"federation_wins from federation", "federation_wins", fromFederation, targetTs, true},
+		{"federation_wins from source", "federation_wins", fromSource, targetTs, false},
+	}
+	for _, tt := range tests {
+		if got := incomingWins(tt.rule, tt.e, tt.targetTs); got != tt.want {
+			t.Errorf("%s: incomingWins = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTemporalType(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want bool
+	}{
+		{"timestamp with time zone", true},
+		{"timestamp(3) without time zone", true},
+		{"date", true},
+		{"time without time zone", false},
+		{"character varying(20)", false},
+		{"integer", false},
+	}
+	for _, tt := range tests {
+		if got := temporalType(tt.typ); got != tt.want {
+			t.Errorf("temporalType(%q) = %v, want %v", tt.typ, got, tt.want)
+		}
+	}
+}
@@ -12,33 +12,34 @@ import (
 	"time"
 )
 
-// tableIncludeList builds the Debezium table.include.list string for all
-// tracked tables in the public schema.
-func tableIncludeList() string {
+// tableIncludeList builds the Debezium table.include.list string for the
+// source's tables in the public schema.
+func tableIncludeList(src source) string {
 	var parts []string
-	for _, t := range tables {
+	for _, t := range src.tableList() {
 		parts = append(parts, "public."+t)
 	}
 	return strings.Join(parts, ",")
 }
 
-// deployConnector posts the Debezium Postgres connector configuration to the
-// Connect REST API, exiting fatally if deployment fails.
+// deployConnector posts the Debezium Postgres connector configuration for one
+// source to the Connect REST API, exiting fatally if deployment fails.
 //
 // Key config choices:
 //   - snapshot.mode=never      → we did pg_dump ourselves, no Debezium snapshot
 //   - time.precision.mode=isostring → timestamps as ISO-8601 strings (Debezium 3.1+)
 //   - decimal.handling.mode=string  → no precision loss on NUMERIC columns
-func deployConnector() {
+//   - heartbeat.interval.ms         → the slot advances on an idle source (cutover waits on it)
+func deployConnector(src source) {
 	cfg := map[string]interface{}{
-		"name": "ome-source",
+		"name": src.Connector,
 		"config": map[string]interface{}{
 			"connector.class":   "io.debezium.connector.postgresql.PostgresConnector",
-			"database.hostname": "postgres1", "database.port": "5432",
-			"database.user": "postgres", "database.password": "postgres", "database.dbname": "omedb",
-			"topic.prefix": "ome", "slot.name": slotName, "plugin.name": "pgoutput",
-			"publication.name": "dbz_publication", "snapshot.mode": "never",
-			"table.include.list":             tableIncludeList(),
+			"database.hostname": src.Host, "database.port": src.Port,
+			"database.user": src.User, "database.password": src.Password, "database.dbname": src.DB,
+			"topic.prefix": src.TopicPrefix, "slot.name": src.Slot, "plugin.name": "pgoutput",
+			"publication.name": src.Publication, "snapshot.mode": "never",
+			"table.include.list":             tableIncludeList(src),
 			"key.converter":                  "org.apache.kafka.connect.json.JsonConverter",
 			"key.converter.schemas.enable":   "false",
 			"value.converter":                "org.apache.kafka.connect.json.JsonConverter",
@@ -46,6 +47,7 @@ func deployConnector() {
 			"tombstones.on.delete":           "false",
 			"decimal.handling.mode":          "string",
 			"time.precision.mode":            "isostring",
+			"heartbeat.interval.ms":          "10000",
 		},
 	}
 	b, _ := json.Marshal(cfg)
@@ -56,17 +58,31 @@ func deployConnector() {
 	defer r.Body.Close()
 	rb, _ := io.ReadAll(r.Body)
 	if r.StatusCode == 201 || r.StatusCode == 200 {
-		log.Println("  Connector deployed")
+		log.Printf("  Connector %s deployed", src.Connector)
 	} else {
 		log.Fatalf("  Deploy error (%d): %s", r.StatusCode, string(rb))
 	}
 }
 
+// ensureConnector deploys the source's connector unless Kafka Connect
+// already runs it, as it does when a standby takes over from a leader.
+func ensureConnector(src source) {
+	r, err := http.Get(debeziumURL + "/connectors/" + src.Connector)
+	if err == nil {
+		r.Body.Close()
+		if r.StatusCode == 200 {
+			log.Printf("  Connector %s already deployed", src.Connector)
+			return
+		}
+	}
+	deployConnector(src)
+}
+
 // waitForConnector polls the Debezium connector status endpoint until the
-// ome-source connector reports RUNNING, or exits fatally on timeout.
-func waitForConnector() {
+// source's connector reports RUNNING, or exits fatally on timeout.
+func waitForConnector(src source) {
 	for i := 0; i < 60; i++ {
-		r, err := http.Get(debeziumURL + "/connectors/ome-source/status")
+		r, err := http.Get(debeziumURL + "/connectors/" + src.Connector + "/status")
 		if err == nil {
 			b, _ := io.ReadAll(r.Body)
 			r.Body.Close()
@@ -74,12 +90,12 @@ func waitForConnector() {
 			json.Unmarshal(b, &s)
 			if c, ok := s["connector"].(map[string]interface{}); ok {
 				if st, _ := c["state"].(string); st == "RUNNING" {
-					log.Println("  Connector RUNNING")
+					log.Printf("  Connector %s RUNNING", src.Connector)
 					return
 				}
 			}
 		}
 		time.Sleep(3 * time.Second)
 	}
-	log.Fatal("  Connector timeout")
+	log.Fatalf("  Connector %s timeout", src.Connector)
 }
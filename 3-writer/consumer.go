@@ -1,32 +1,57 @@
-// consumer.go — Kafka CDC consumer and postgres2 writer.
-// Each table gets its own goroutine reading from Kafka partition 0 and applying
-// upserts/deletes to postgres2 via ON CONFLICT.
+// consumer.go — Kafka CDC consumer.
+// Each source table gets its own goroutine reading from Kafka partition 0, grouping
+// messages into batches and handing them to the table's Sink (see sink.go),
+// or to a per-table worker pool for tables with Workers > 1 (see workers.go).
 package main
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
 )
 
-// consumeAndWrite continuously consumes CDC events from the given Kafka topic
-// (partition 0) and applies them to the specified postgres2 table, reconnecting
-// the reader on errors.
-func consumeAndWrite(ctx context.Context, topic, table string) {
+// consumeAndWrite continuously consumes CDC events of one source table from
+// Kafka (partition 0) and applies them to the table's configured sink.
+// Fetching stops when ctx is cancelled; batches already fetched are still
+// applied and checkpointed under applyCtx, which is only cancelled when the
+// shutdown deadline passes.
+func consumeAndWrite(ctx, applyCtx context.Context, src source, table string) {
+	topic := src.topic(table)
 	log.Printf("  [consumer] %s -> %s", topic, table)
+	sink := sinkFor(table)
+	var pool *workerPool
+	if n := configFor(table).Workers; n > 1 {
+		pool = newWorkerPool(applyCtx, sink, table, n)
+		defer pool.close()
+	}
+	readTopic(ctx, topic, resumeOffset(applyCtx, topic, sinkCheckpoints(configFor(table).Sinks)), func(msgs []kafka.Message) {
+		throttle.admit(ctx, table, len(msgs))
+		batch, pos, ok := retryPrepare(applyCtx, table, func() ([]changeEvent, position, error) {
+			return prepareBatch(applyCtx, src.Site, topic, table, msgs)
+		})
+		if !ok {
+			return
+		}
+		if pool != nil {
+			pool.submit(applyCtx, batch, pos)
+		} else {
+			applyBatch(applyCtx, sink, table, batch, pos)
+		}
+	})
+	log.Printf("  [consumer] %s stopped", topic)
+}
 
+// readTopic reads partition 0 of a topic from offset and hands every batch
+// to handle, reconnecting the reader on errors, until ctx is cancelled.
+func readTopic(ctx context.Context, topic string, offset int64, handle func([]kafka.Message)) {
 	// Use direct partition reader instead of consumer groups.
 	// Consumer groups with kafka-go + KRaft can have rebalance issues.
 	// Direct partition 0 reader is simpler and reliable for single-broker.
-	for {
+	for ctx.Err() == nil {
 		r := kafka.NewReader(kafka.ReaderConfig{
 			Brokers:   []string{kafkaBroker},
 			Topic:     topic,
@@ -35,169 +60,149 @@ func consumeAndWrite(ctx context.Context, topic, table string) {
 			MaxBytes:  10e6,
 			MaxWait:   1 * time.Second,
 		})
-		r.SetOffset(kafka.FirstOffset)
+		r.SetOffset(offset)
 
 		for {
-			msg, err := r.ReadMessage(ctx)
+			msgs, err := readBatch(ctx, r)
+			if len(msgs) > 0 {
+				noteFetched(topic, msgs[len(msgs)-1].Offset)
+				handle(msgs)
+				offset = msgs[len(msgs)-1].Offset + 1
+			}
 			if err != nil {
-				log.Printf("  [consumer] %s read error: %v", table, err)
 				r.Close()
-				time.Sleep(2 * time.Second)
+				if ctx.Err() != nil {
+					break
+				}
+				log.Printf("  [consumer] %s read error: %v", topic, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(2 * time.Second):
+				}
 				break
 			}
-			applyToPostgres2(table, msg.Value)
 		}
 	}
 }
 
-// applyToPostgres2 interprets a Debezium CDC message value, derives the op,
-// before, and after payload fields, and performs an upsert or delete on
-// postgres2 accordingly.
-func applyToPostgres2(table string, value []byte) {
-	var ev map[string]interface{}
-	if json.Unmarshal(value, &ev) != nil {
-		return
-	}
-	p := ev
-	if pp, ok := ev["payload"].(map[string]interface{}); ok {
-		p = pp
-	}
-	op, _ := p["op"].(string)
-	after, _ := p["after"].(map[string]interface{})
-	before, _ := p["before"].(map[string]interface{})
-
-	db, err := sql.Open("postgres", pg2DSN)
+// readBatch blocks for the first message, then keeps reading until batchSize
+// messages are collected or batchLinger elapses without filling the batch.
+// Messages read before an error are returned alongside it.
+func readBatch(ctx context.Context, r *kafka.Reader) ([]kafka.Message, error) {
+	msg, err := r.ReadMessage(ctx)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer db.Close()
-
-	switch op {
-	case "c", "r", "u":
-		if after != nil {
-			upsert(db, table, after)
-		}
-	case "d":
-		if before != nil {
-			del(db, table, before)
+	msgs := []kafka.Message{msg}
+
+	lctx, cancel := context.WithTimeout(ctx, batchLinger)
+	defer cancel()
+	for len(msgs) < batchSize {
+		msg, err := r.ReadMessage(lctx)
+		if err != nil {
+			if lctx.Err() != nil && ctx.Err() == nil {
+				return msgs, nil // linger expired
+			}
+			return msgs, err
 		}
+		msgs = append(msgs, msg)
 	}
+	return msgs, nil
 }
 
-// ═══════════════════════════════════════════════════════════════
-// TIMESTAMP AUTO-DETECTION FROM SCHEMA
-// ═══════════════════════════════════════════════════════════════
-
-// tsCache caches the set of timestamp column names per table so we only
-// query information_schema once per table.
-var (
-	tsCache   = make(map[string]map[string]bool)
-	tsCacheMu sync.Mutex
-)
-
-// getTimestampColumns returns a set of column names that are timestamp/date
-// types for the given table. Results are cached after first lookup.
-func getTimestampColumns(db *sql.DB, table string) map[string]bool {
-	tsCacheMu.Lock()
-	defer tsCacheMu.Unlock()
-
-	if cols, ok := tsCache[table]; ok {
-		return cols
-	}
-
-	cols := make(map[string]bool)
-	rows, err := db.Query(`
-		SELECT column_name FROM information_schema.columns
-		WHERE table_schema='public' AND table_name=$1
-		  AND data_type IN ('timestamp without time zone','timestamp with time zone','date')`, table)
-	if err != nil {
-		tsCache[table] = cols
-		return cols
+// applyBatch applies prepared events to the sink, retrying the whole batch
+// until the sink accepts it, then flushes and checkpoints. A batch emptied
+// by filters still advances the checkpoint; a batch abandoned at the
+// shutdown deadline does not.
+func applyBatch(ctx context.Context, sink Sink, table string, batch []changeEvent, pos position) {
+	if !applyEvents(ctx, sink, table, batch) {
+		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var name string
-		rows.Scan(&name)
-		cols[name] = true
+	if err := sink.Checkpoint(ctx, pos); err != nil {
+		log.Printf("  [consumer] %s checkpoint: %v", table, err)
+		return
 	}
-	tsCache[table] = cols
-	return cols
+	noteApplied(pos.Topic, pos.Offset)
 }
 
-// convertTimestamp converts Debezium epoch-encoded temporal values to Go time.Time.
-//
-// Debezium 3.4 with time.precision.mode=isostring sends timestamps as
-// ISO-8601 strings (e.g. "2026-02-16T21:04:46.955Z") which PostgreSQL accepts
-// natively. This function handles the fallback case where the value is still
-// numeric (e.g. if isostring mode was not applied for some fields).
-func convertTimestamp(v interface{}) interface{} {
-	if v == nil {
-		return nil
-	}
-	switch n := v.(type) {
-	case float64:
-		epoch := int64(n)
-		if epoch == 0 {
-			return v
+// retryPrepare runs prepare until it succeeds, like applyEvents retries the
+// sink. It gives up only when ctx is cancelled and reports whether the batch
+// was prepared.
+func retryPrepare(ctx context.Context, table string, prepare func() ([]changeEvent, position, error)) ([]changeEvent, position, bool) {
+	for attempt := 1; ; attempt++ {
+		batch, pos, err := prepare()
+		if err == nil {
+			return batch, pos, true
+		}
+		if ctx.Err() != nil {
+			log.Printf("  [consumer] %s: abandoned batch at shutdown", table)
+			return nil, pos, false
 		}
-		// Try as microseconds first: if year < 2000, it's actually milliseconds
-		asUsec := time.Unix(epoch/1_000_000, (epoch%1_000_000)*1000)
-		if asUsec.Year() >= 2000 && asUsec.Year() <= 2100 {
-			return asUsec // It's microseconds
+		log.Printf("  [consumer] %s prepare (attempt %d): %v", table, attempt, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
 		}
-		// Otherwise treat as milliseconds
-		return time.Unix(epoch/1_000, (epoch%1_000)*1_000_000)
-	default:
-		return v // strings (ISO-8601) pass through — PG accepts them natively
 	}
 }
 
-// ═══════════════════════════════════════════════════════════════
-// UPSERT + DELETE
-// ═══════════════════════════════════════════════════════════════
-
-// upsert builds and executes an INSERT ... ON CONFLICT(id) DO UPDATE statement
-// for the given table and row data, auto-detecting timestamp columns from the
-// schema and converting Debezium epoch values to time.Time.
-func upsert(db *sql.DB, table string, data map[string]interface{}) {
-	id := data["id"]
-	tsCols := getTimestampColumns(db, table)
-
-	var cols, phs, ups []string
-	var vals []interface{}
-	i := 1
-	for k, v := range data {
-		cols = append(cols, fmt.Sprintf(`"%s"`, k))
-		phs = append(phs, fmt.Sprintf("$%d", i))
-		if k != "id" {
-			ups = append(ups, fmt.Sprintf(`"%s"=$%d`, k, i))
+// prepareBatch decodes, filters, masks and maps the messages, returning the
+// events to apply and the position reached once they are applied. With
+// failback on, changes failback itself wrote to the source are dropped. A
+// filter or echo lookup that fails is returned as an error so the batch is
+// retried.
+func prepareBatch(ctx context.Context, site, topic, table string, msgs []kafka.Message) ([]changeEvent, position, error) {
+	batch := make([]changeEvent, 0, len(msgs))
+	var lsn int64 // source position of the last decoded event
+	for _, m := range msgs {
+		e, err := decodeEvent(table, m.Value)
+		if err != nil {
+			continue
 		}
-		// Auto-convert timestamp columns detected from schema
-		if tsCols[k] {
-			vals = append(vals, convertTimestamp(v))
-		} else {
-			vals = append(vals, v)
+		e.Site, e.Topic, e.Offset = site, topic, m.Offset
+		lsn = e.LSN
+		e, ok, err := filterEvent(ctx, e)
+		if err != nil {
+			return nil, position{}, fmt.Errorf("filter: %w", err)
+		}
+		if ok {
+			batch = append(batch, mapEvent(maskEvent(e)))
 		}
-		i++
-	}
-	if len(ups) == 0 {
-		return
 	}
-	q := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (id) DO UPDATE SET %s`,
-		table, strings.Join(cols, ","), strings.Join(phs, ","), strings.Join(ups, ","))
-	if _, err := db.Exec(q, vals...); err != nil {
-		log.Printf("  [writer] upsert %s id=%v: %v", table, id, err)
-	} else {
-		atomic.AddInt64(&written, 1)
-		log.Printf("  [writer] synced %s id=%v", table, id)
+	if failbackEnabled {
+		var err error
+		if batch, err = dropEchoes(ctx, sourceFor(site).dsn(), batch); err != nil {
+			return nil, position{}, err
+		}
 	}
+	last := msgs[len(msgs)-1]
+	// Filtered-out and echoed events count: their position is passed too,
+	// which lets origin tags be pruned behind it (see origin.go).
+	return batch, position{Topic: topic, Offset: last.Offset, LSN: lsn}, nil
 }
 
-// del issues a DELETE statement on postgres2 for the given table and primary
-// key id, incrementing the CDC event counter.
-func del(db *sql.DB, table string, data map[string]interface{}) {
-	id := data["id"]
-	db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=$1", table), id)
-	atomic.AddInt64(&written, 1)
-	log.Printf("  [writer] deleted %s id=%v", table, id)
+// applyEvents applies decoded events to the sink, retrying until the sink
+// accepts and flushes them. It gives up only when ctx is cancelled and
+// reports whether the events were applied.
+func applyEvents(ctx context.Context, sink Sink, table string, batch []changeEvent) bool {
+	for attempt := 1; ; attempt++ {
+		err := sink.Apply(ctx, batch)
+		if err == nil {
+			err = sink.Flush(ctx)
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			log.Printf("  [consumer] %s: abandoned %d events at shutdown", table, len(batch))
+			return false
+		}
+		log.Printf("  [consumer] %s apply (attempt %d): %v", table, attempt, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+	atomic.AddInt64(&written, int64(len(batch)))
+	return true
 }
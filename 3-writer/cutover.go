@@ -0,0 +1,460 @@
+// cutover.go — Planned switchover from the OME sources to postgres2.
+// Run next to the streaming writer:
+//
+//	podman exec writer writer cutover        freeze sources, drain, reconcile, go/no-go
+//	podman exec writer writer cutover abort  make the sources writable again
+//
+// The sources are frozen (write privileges on the replicated tables revoked
+// and recorded in _cdc_freeze, new sessions default to read-only, open
+// application sessions terminated), then the cutover waits until every
+// slot's confirmed_flush_lsn has passed the source's final WAL position and
+// the writer has checkpointed every Kafka offset Debezium produced up to it.
+// A final reconciliation compares row counts and key sets per table, and the
+// postgres2 sequences are moved past the replicated ids. Every step is timed
+// for the go/no-go report; the exit code is 0 only for GO.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// cutoverStep is one line of the go/no-go report.
+type cutoverStep struct {
+	name   string
+	err    error
+	took   time.Duration
+	detail string
+}
+
+// runCutover performs the switchover and prints the report. It returns the
+// process exit code.
+func runCutover() int {
+	log.Println("╔══════════════════════════════════════════════════════════╗")
+	log.Println("║  CUTOVER: sources → postgres2                            ║")
+	log.Println("╚══════════════════════════════════════════════════════════╝")
+	ctx, cancel := context.WithTimeout(context.Background(), cutoverTimeout)
+	defer cancel()
+	start := time.Now()
+
+	var steps []cutoverStep
+	run := func(name string, fn func() (string, error)) bool {
+		log.Printf("\n[cutover] %s...", name)
+		t := time.Now()
+		detail, err := fn()
+		steps = append(steps, cutoverStep{name: name, err: err, took: time.Since(t), detail: detail})
+		if err != nil {
+			log.Printf("  FAILED: %v", err)
+		} else if detail != "" {
+			log.Printf("  %s", detail)
+		}
+		return err == nil
+	}
+
+	lsns := make(map[string]string, len(sources))
+	ok := true
+	for _, src := range sources {
+		ok = ok && run("Freeze "+src.Site, func() (string, error) {
+			lsn, revoked, n, err := freezeSource(ctx, src)
+			lsns[src.Site] = lsn
+			return fmt.Sprintf("read-only, %d grants revoked, %d sessions terminated, final LSN %s", revoked, n, lsn), err
+		})
+	}
+	for _, src := range sources {
+		ok = ok && run("Slot "+src.Slot+" flushed", func() (string, error) {
+			return waitSlotFlushed(ctx, src, lsns[src.Site])
+		})
+	}
+	ok = ok && run("Writer applied", func() (string, error) {
+		return waitApplied(ctx)
+	})
+	// Reconciliation and sequences also run after a failure so the report
+	// shows the state the target is in.
+	run("Reconciliation", func() (string, error) {
+		return reconcile(ctx)
+	})
+	run("Sequence sync", func() (string, error) {
+		n, err := syncSequences(ctx)
+		return fmt.Sprintf("%d sequences advanced", n), err
+	})
+
+	goAhead := true
+	log.Println("\n══════════════════════════════════════════════════════════")
+	log.Println("  CUTOVER REPORT")
+	log.Println("══════════════════════════════════════════════════════════")
+	for _, s := range steps {
+		status := "OK"
+		if s.err != nil {
+			status = "FAIL"
+			goAhead = false
+		}
+		log.Printf("  %-4s %-32s %8v", status, s.name, s.took.Round(time.Millisecond))
+		if s.err != nil {
+			log.Printf("       %v", s.err)
+		}
+	}
+	log.Printf("  Total: %v", time.Since(start).Round(time.Millisecond))
+	if goAhead {
+		log.Println("  ► GO: postgres2 holds every source change; point applications at postgres2")
+		log.Println("══════════════════════════════════════════════════════════")
+		return 0
+	}
+	log.Println("  ► NO-GO: sources stay read-only; fix the failures and rerun,")
+	log.Println("    or reopen the sources with `writer cutover abort`")
+	log.Println("══════════════════════════════════════════════════════════")
+	return 1
+}
+
+// abortCutover makes the sources writable again and restores the grants
+// the freeze revoked.
+func abortCutover() int {
+	code := 0
+	for _, src := range sources {
+		err := setReadOnly(context.Background(), src, false)
+		var n int
+		if err == nil {
+			n, err = restoreGrants(context.Background(), src)
+		}
+		if err != nil {
+			log.Printf("[cutover] %s: %v", src.Site, err)
+			code = 1
+			continue
+		}
+		log.Printf("[cutover] %s is writable again, %d grants restored", src.Site, n)
+	}
+	return code
+}
+
+// setReadOnly sets or resets default_transaction_read_only on the source
+// database. The session opts out first, since ALTER DATABASE is refused in a
+// read-only transaction.
+func setReadOnly(ctx context.Context, src source, on bool) error {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	q := "SET default_transaction_read_only = off; ALTER DATABASE %s RESET default_transaction_read_only"
+	if on {
+		q = "SET default_transaction_read_only = off; ALTER DATABASE %s SET default_transaction_read_only = on"
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(q, quoteIdent(src.DB)))
+	return err
+}
+
+// freezeDDL creates the source table recording the grants a freeze revoked.
+const freezeDDL = `CREATE TABLE IF NOT EXISTS _cdc_freeze (
+	grantee TEXT NOT NULL, table_name TEXT NOT NULL, privilege TEXT NOT NULL,
+	frozen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (grantee, table_name, privilege))`
+
+// freezeSource revokes the write privileges on the replicated tables, makes
+// the source read-only and terminates the application sessions opened
+// before, so no write can commit after the returned LSN. A session that
+// turns read-only off again still lacks the privileges; only the writer's
+// own user (a superuser, as Debezium needs) keeps writing rights.
+// Debezium's sessions and walsenders are left alone.
+func freezeSource(ctx context.Context, src source) (lsn string, revoked, terminated int, err error) {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer db.Close()
+	if revoked, err = revokeWrites(ctx, db, src); err != nil {
+		return "", 0, 0, err
+	}
+	if err := setReadOnly(ctx, src, true); err != nil {
+		return "", revoked, 0, err
+	}
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE pg_terminate_backend(pid)) FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid() AND backend_type = 'client backend'
+		  AND application_name NOT LIKE 'Debezium%'`, src.DB).Scan(&terminated)
+	if err != nil {
+		return "", revoked, 0, err
+	}
+	err = db.QueryRowContext(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&lsn)
+	return lsn, revoked, terminated, err
+}
+
+// revokeWrites records in _cdc_freeze and revokes every INSERT, UPDATE,
+// DELETE and TRUNCATE grant on the source's tables held by other roles. A
+// rerun keeps the grants recorded by the first freeze.
+func revokeWrites(ctx context.Context, db *sql.DB, src source) (int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// A previous freeze may have made new sessions read-only already.
+	if _, err := conn.ExecContext(ctx, "SET default_transaction_read_only = off"); err != nil {
+		return 0, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, freezeDDL); err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT grantee, table_name, privilege_type FROM information_schema.role_table_grants
+		WHERE table_schema = 'public' AND table_name = ANY($1)
+		  AND privilege_type IN ('INSERT', 'UPDATE', 'DELETE', 'TRUNCATE')
+		  AND grantee <> current_user`, pq.Array(src.tableList()))
+	if err != nil {
+		return 0, err
+	}
+	grants, err := scanGrants(rows)
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range grants {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO _cdc_freeze (grantee, table_name, privilege)
+			VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, g[0], g[1], g[2]); err != nil {
+			return 0, err
+		}
+		q := fmt.Sprintf("REVOKE %s ON public.%s FROM %s", g[2], quoteIdent(g[1]), grantee(g[0]))
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return 0, fmt.Errorf("%s: %w", q, err)
+		}
+	}
+	return len(grants), tx.Commit()
+}
+
+// restoreGrants grants back what the freezes recorded in _cdc_freeze and
+// empties it. A source that was never frozen has nothing to restore.
+func restoreGrants(ctx context.Context, src source) (int, error) {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('public._cdc_freeze') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "DELETE FROM _cdc_freeze RETURNING grantee, table_name, privilege")
+	if err != nil {
+		return 0, err
+	}
+	grants, err := scanGrants(rows)
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range grants {
+		q := fmt.Sprintf("GRANT %s ON public.%s TO %s", g[2], quoteIdent(g[1]), grantee(g[0]))
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return 0, fmt.Errorf("%s: %w", q, err)
+		}
+	}
+	return len(grants), tx.Commit()
+}
+
+// scanGrants reads (grantee, table, privilege) rows and closes them.
+func scanGrants(rows *sql.Rows) ([][3]string, error) {
+	defer rows.Close()
+	var grants [][3]string
+	for rows.Next() {
+		var g [3]string
+		if err := rows.Scan(&g[0], &g[1], &g[2]); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// grantee quotes a role name for GRANT/REVOKE, leaving the PUBLIC
+// pseudo-role as a keyword.
+func grantee(role string) string {
+	if role == "PUBLIC" {
+		return role
+	}
+	return quoteIdent(role)
+}
+
+// waitSlotFlushed blocks until Debezium has confirmed the slot up to lsn.
+// On an idle source the connector's heartbeat moves the slot forward.
+func waitSlotFlushed(ctx context.Context, src source, lsn string) (string, error) {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var flushed string
+	for {
+		var done bool
+		err := db.QueryRowContext(ctx, `
+			SELECT confirmed_flush_lsn >= $1::pg_lsn, confirmed_flush_lsn::text
+			FROM pg_replication_slots WHERE slot_name = $2`, lsn, src.Slot).Scan(&done, &flushed)
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("slot %s does not exist", src.Slot)
+		}
+		if err == nil && done {
+			return "confirmed_flush_lsn " + flushed, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("slot at %s, waiting for %s: %w", flushed, lsn, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitApplied blocks until every topic has been checkpointed up to its
+// last Kafka offset by all sinks its table is routed to (sinkCheckpoints).
+// In pgoutput mode a slot is only confirmed once its changes are applied,
+// so a flushed slot suffices.
+func waitApplied(ctx context.Context) (string, error) {
+	if sourceMode == "pgoutput" {
+		return "pgoutput: flushed slots are applied", nil
+	}
+	var topics int
+	var events int64
+	for _, src := range sources {
+		for _, t := range src.tableList() {
+			topic := src.topic(t)
+			read := sinkCheckpoints(configFor(t).Sinks)
+			topics++
+			last, err := lastOffset(ctx, topic)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", topic, err)
+			}
+			if last < 0 {
+				continue // no event was ever produced
+			}
+			for {
+				var applied int64 = -1
+				pos, ok, err := read(ctx, topic)
+				if err != nil {
+					return "", fmt.Errorf("%s: %w", topic, err)
+				}
+				if ok {
+					applied = pos.Offset
+				}
+				if applied >= last {
+					events += last + 1
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return "", fmt.Errorf("%s applied→%d of %d: %w", topic, applied, last, ctx.Err())
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("%d topics checkpointed, %d events", topics, events), nil
+}
+
+// lastOffset returns the offset of the last message in partition 0 of a
+// topic, or -1 when the topic is empty or does not exist.
+func lastOffset(ctx context.Context, topic string) (int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", kafkaBroker, topic, 0)
+	if errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	end, err := conn.ReadLastOffset()
+	return end - 1, err
+}
+
+// reconcile compares, per table and source, the rows the filters keep on the
+// source with the live rows on postgres2: count and a hash of the set of
+// primary keys (sourceKey, renamed on the target).
+func reconcile(ctx context.Context) (string, error) {
+	db2, err := sql.Open("postgres", pg2DSN)
+	if err != nil {
+		return "", err
+	}
+	defer db2.Close()
+	var mismatched []string
+	checked := 0
+	for _, src := range sources {
+		db1, err := sql.Open("postgres", src.dsn())
+		if err != nil {
+			return "", err
+		}
+		for _, t := range tables {
+			cfg := configFor(t)
+			const agg = `SELECT COUNT(*), COALESCE(md5(string_agg(%[1]s::text, ',' ORDER BY %[1]s)), '') FROM %[2]s WHERE %[3]s`
+
+			cond, args := "true", []interface{}(nil)
+			if len(cfg.Where) > 0 {
+				if cond, args, err = predicatesSQL(ctx, src.dsn(), cfg.Where); err != nil {
+					db1.Close()
+					return "", fmt.Errorf("%s filter: %w", t, err)
+				}
+			}
+			var n1 int64
+			var h1 string
+			key := sourceKey(t)
+			q1 := fmt.Sprintf(agg, keyExpr(key), quoteIdent(t), cond)
+			if err := db1.QueryRowContext(ctx, q1, args...).Scan(&n1, &h1); err != nil {
+				db1.Close()
+				return "", fmt.Errorf("%s source %s: %w", t, src.Site, err)
+			}
+
+			schema, name := targetOf(t)
+			conds, args2 := []string{"true"}, []interface{}(nil)
+			if multiSource() {
+				args2 = append(args2, src.Site)
+				conds = append(conds, quoteIdent(siteColumn)+"=$1")
+			}
+			if cfg.SoftDelete {
+				conds = append(conds, "NOT _deleted")
+			}
+			var n2 int64
+			var h2 string
+			targetKey := make([]string, len(key))
+			for i, c := range key {
+				targetKey[i] = targetColumn(cfg, c)
+			}
+			q2 := fmt.Sprintf(agg, keyExpr(targetKey), quoteIdent(schema)+"."+quoteIdent(name), strings.Join(conds, " AND "))
+			if err := db2.QueryRowContext(ctx, q2, args2...).Scan(&n2, &h2); err != nil {
+				db1.Close()
+				return "", fmt.Errorf("%s target: %w", t, err)
+			}
+
+			checked++
+			status := "MATCH"
+			if n1 != n2 || h1 != h2 {
+				status = "MISMATCH"
+				mismatched = append(mismatched, src.Site+"/"+t)
+			}
+			log.Printf("  %-8s %-6s %-25s source=%d target=%d", status, src.Site, t, n1, n2)
+		}
+		db1.Close()
+	}
+	if len(mismatched) > 0 {
+		return "", fmt.Errorf("%d of %d tables differ: %s", len(mismatched), checked, strings.Join(mismatched, ", "))
+	}
+	return fmt.Sprintf("%d tables match", checked), nil
+}
+
+// keyExpr renders key columns as one expression, a row value for composite
+// keys, that sorts and casts to text alike on both sides.
+func keyExpr(cols []string) string {
+	if len(cols) == 1 {
+		return quoteIdent(cols[0])
+	}
+	return "ROW(" + quoteIdents(cols) + ")"
+}
@@ -0,0 +1,33 @@
+// cutover_test.go — Tests for the reconciliation key and grant rendering.
+package main
+
+import "testing"
+
+func TestKeyExpr(t *testing.T) {
+	tests := []struct {
+		cols []string
+		want string
+	}{
+		{[]string{"id"}, `"id"`},
+		{[]string{"tenant", "serial"}, `ROW("tenant","serial")`},
+		{[]string{"Device ID"}, `"Device ID"`},
+	}
+	for _, tt := range tests {
+		if got := keyExpr(tt.cols); got != tt.want {
+			t.Errorf("keyExpr(%v) = %s, want %s", tt.cols, got, tt.want)
+		}
+	}
+}
+
+func TestGrantee(t *testing.T) {
+	tests := []struct{ role, want string }{
+		{"PUBLIC", "PUBLIC"},
+		{"ome_app", `"ome_app"`},
+		{"public", `"public"`},
+	}
+	for _, tt := range tests {
+		if got := grantee(tt.role); got != tt.want {
+			t.Errorf("grantee(%q) = %s, want %s", tt.role, got, tt.want)
+		}
+	}
+}
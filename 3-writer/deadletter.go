@@ -0,0 +1,109 @@
+// deadletter.go — Dead-letter store for events a sink could not apply.
+// Rows land in postgres2's _cdc_dead_letters table with the full event and
+// the error, so nothing is silently dropped and failures can be replayed.
+// The postgres2 sink inserts them in the batch's own transaction; other
+// sinks record them once their batch has been applied (deadLetters).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// deadLetterDB is the postgres2 pool used for dead letters, opened lazily.
+// A failed open is retried on the next dead letter.
+var (
+	deadLetterDB   *sql.DB
+	deadLetterDBMu sync.Mutex
+)
+
+// openDeadLetters connects to postgres2 and creates _cdc_dead_letters.
+func openDeadLetters(ctx context.Context) (*sql.DB, error) {
+	deadLetterDBMu.Lock()
+	defer deadLetterDBMu.Unlock()
+	if deadLetterDB != nil {
+		return deadLetterDB, nil
+	}
+	db, err := sql.Open("postgres", pg2DSN)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS _cdc_dead_letters (
+		id BIGSERIAL PRIMARY KEY, sink TEXT NOT NULL, table_name TEXT NOT NULL,
+		op TEXT NOT NULL, lsn BIGINT, tx_id BIGINT, kafka_topic TEXT, kafka_offset BIGINT,
+		before JSONB, after JSONB, error TEXT NOT NULL,
+		failed_at TIMESTAMPTZ NOT NULL DEFAULT NOW())`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	deadLetterDB = db
+	return db, nil
+}
+
+// closeDeadLetters closes the dead-letter pool if it was opened.
+func closeDeadLetters() {
+	deadLetterDBMu.Lock()
+	defer deadLetterDBMu.Unlock()
+	if deadLetterDB != nil {
+		deadLetterDB.Close()
+		deadLetterDB = nil
+	}
+}
+
+// insertDeadLetter writes one dead letter through tx, which is either the
+// dead-letter pool or a transaction on postgres2.
+func insertDeadLetter(ctx context.Context, tx interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, sink string, e changeEvent, cause error) error {
+	before, _ := json.Marshal(e.Before)
+	after, _ := json.Marshal(e.After)
+	_, err := tx.ExecContext(ctx, `INSERT INTO _cdc_dead_letters
+		(sink,table_name,op,lsn,tx_id,kafka_topic,kafka_offset,before,after,error)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)`,
+		sink, e.Table, e.Op, e.LSN, e.TxID, e.Topic, e.Offset, before, after, cause.Error())
+	if err == nil {
+		log.Printf("  [dead-letter] %s %s key=%v: %v", sink, e.Table, keyValues(e.Key, e.row()), cause)
+	}
+	return err
+}
+
+// deadLetter records an event that the named sink gave up on. If the
+// dead-letter table itself is unreachable the event is logged in full.
+func deadLetter(ctx context.Context, sink string, e changeEvent, cause error) {
+	db, err := openDeadLetters(ctx)
+	if err == nil {
+		err = insertDeadLetter(ctx, db, sink, e, cause)
+	}
+	if err != nil {
+		before, _ := json.Marshal(e.Before)
+		after, _ := json.Marshal(e.After)
+		log.Printf("  [dead-letter] %s %s offset=%d LOST TO LOG (%v): before=%s after=%s cause=%v",
+			sink, e.Table, e.Offset, err, before, after, cause)
+	}
+}
+
+// deadLetters collects the events a sink gives up on while applying a
+// batch. They are recorded once the batch has committed, so a batch that
+// fails and is retried does not dead-letter them twice.
+type deadLetters []deadLetterEntry
+
+type deadLetterEntry struct {
+	sink  string
+	e     changeEvent
+	cause error
+}
+
+func (d *deadLetters) add(sink string, e changeEvent, cause error) {
+	*d = append(*d, deadLetterEntry{sink, e, cause})
+}
+
+// record dead-letters the collected events.
+func (d deadLetters) record(ctx context.Context) {
+	for _, x := range d {
+		deadLetter(ctx, x.sink, x.e, x.cause)
+	}
+}
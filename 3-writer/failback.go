@@ -0,0 +1,369 @@
+// failback.go — Reverse replication from postgres2 back to postgres1.
+// With WRITER_FAILBACK=true the writer also runs the pipeline the other way,
+// so OME can be brought back after cutover without losing what was written
+// on postgres2: a publication and slot on postgres2, a second Debezium
+// connector (topics <failback.TopicPrefix>.public.<table>) and one consumer
+// per table applying into postgres1. Its sessions override the read-only
+// default cutover puts on omedb.
+//
+// Loops are cut by origin tagging (see origin.go): the forward sink tags its
+// postgres2 transactions and the failback sink its postgres1 transactions,
+// and each consumer drops the events of the other side's tagged ones. Rows
+// changed on both sides meanwhile are reconciled in both sinks by
+// conflict.go, which makes the two directions an active-active pair.
+//
+// Only unmapped tables flow back, since a mapped target has no inverse
+// mapping, and only with a single source. Writer-managed columns are
+// stripped, and masked or projected-away columns are never overwritten on
+// postgres1, so the originals survive the round trip. postgres1's sequences
+// are kept past postgres2's (syncFailbackSequences).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// failbackTables returns the tables replicated back into postgres1.
+func failbackTables() []string {
+	var out []string
+	for _, t := range tables {
+		if isMapped(t) {
+			log.Printf("  [failback] %s is mapped on postgres2, not replicated back", t)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// failbackDSN is postgres1's DSN for the failback sink. Its sessions stay
+// writable while cutover keeps the database read-only for applications.
+func failbackDSN() string {
+	return sources[0].dsn() + "&default_transaction_read_only=off"
+}
+
+// teardownFailback removes the failback connector and slot. A bootstrap
+// calls it before dropping omedb on postgres2, which a slot would block; the
+// slot is recreated on the restored database.
+func teardownFailback() {
+	req, _ := http.NewRequest(http.MethodDelete, debeziumURL+"/connectors/"+failback.Connector, nil)
+	if r, err := http.DefaultClient.Do(req); err == nil {
+		r.Body.Close()
+		if r.StatusCode == 204 {
+			log.Printf("  [failback] Connector %s removed", failback.Connector)
+		}
+	}
+	db, err := sql.Open("postgres", pg2AdminDSN)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	// The slot stays active until the connector's task has stopped.
+	for i := 0; i < 30; i++ {
+		var active sql.NullBool
+		err := db.QueryRow("SELECT active FROM pg_replication_slots WHERE slot_name=$1", failback.Slot).Scan(&active)
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err == nil && !active.Bool {
+			if _, err := db.Exec("SELECT pg_drop_replication_slot($1)", failback.Slot); err != nil {
+				log.Printf("  [failback] drop slot: %v", err)
+			} else {
+				log.Printf("  [failback] Slot %s dropped", failback.Slot)
+			}
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	log.Printf("  [failback] slot %s still active, not dropped", failback.Slot)
+}
+
+// setupFailback makes postgres2 a source for the given tables: it checks
+// wal_level, creates or updates the publication, sets REPLICA IDENTITY FULL
+// on both sides, creates the slot when missing and deploys the connector
+// when it is not running yet.
+func setupFailback(ctx context.Context, tbls []string) error {
+	db, err := sql.Open("postgres", failback.dsn())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var level string
+	if err := db.QueryRowContext(ctx, "SHOW wal_level").Scan(&level); err != nil {
+		return err
+	}
+	if level != "logical" {
+		return fmt.Errorf("postgres2 runs with wal_level=%s; restart it with -c wal_level=logical", level)
+	}
+
+	if err := syncPublication(ctx, db, failback.Publication, tbls); err != nil {
+		return fmt.Errorf("publication: %w", err)
+	}
+
+	// Conflict detection compares full before images, on both sides.
+	for _, dsn := range []string{failback.dsn(), failbackDSN()} {
+		if err := replicaIdentityFull(ctx, dsn, tbls); err != nil {
+			return fmt.Errorf("replica identity: %w", err)
+		}
+	}
+
+	var exists bool
+	db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name=$1)", failback.Slot).Scan(&exists)
+	if !exists {
+		var lsn string
+		if err := db.QueryRowContext(ctx, "SELECT lsn::text FROM pg_create_logical_replication_slot($1, 'pgoutput')", failback.Slot).Scan(&lsn); err != nil {
+			return fmt.Errorf("slot: %w", err)
+		}
+		log.Printf("  [failback] Slot '%s' on postgres2 at LSN %s", failback.Slot, lsn)
+	}
+
+	src := failback
+	src.Tables = tbls
+	ensureConnector(src)
+	waitForConnector(src)
+	return nil
+}
+
+// replicaIdentityFull makes the tables log full before images.
+func replicaIdentityFull(ctx context.Context, dsn string, tbls []string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, t := range tbls {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", quoteIdent(t))); err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// startFailback sets up the reverse pipeline and starts one consumer per
+// table under consumers, so shutdown drains them with the forward ones.
+func startFailback(ctx, applyCtx context.Context, consumers *sync.WaitGroup) {
+	if multiSource() {
+		log.Println("  [failback] not supported with several sources, disabled")
+		return
+	}
+	if sourceMode != "kafka" {
+		log.Println("  [failback] requires WRITER_SOURCE_MODE=kafka, disabled")
+		return
+	}
+	tbls := failbackTables()
+	if err := setupFailback(applyCtx, tbls); err != nil {
+		log.Fatalf("  [failback] %v", err)
+	}
+	sink, err := newFailbackSink()
+	if err != nil {
+		log.Fatalf("  [failback] postgres1: %v", err)
+	}
+	openSinksMu.Lock()
+	openSinksMap["failback"] = sink
+	openSinksMu.Unlock()
+
+	for _, t := range tbls {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consumeFailback(ctx, applyCtx, sink, t)
+		}()
+	}
+	// postgres2's tags are consumed by the failback consumers, postgres1's
+	// by the forward ones.
+	back, forward := make(originReaders), make(originReaders)
+	for _, t := range tbls {
+		back[failback.topic(t)] = pgCheckpoints(failbackDSN())
+	}
+	for _, t := range sources[0].tableList() {
+		forward[sources[0].topic(t)] = sinkCheckpoints(configFor(t).Sinks)
+	}
+	go pruneOriginsLoop(ctx, map[string]originReaders{pg2DSN: back, failbackDSN(): forward})
+	go syncSequencesLoop(ctx, syncFailbackSequences)
+	log.Printf("  [failback] %d tables replicating postgres2 → postgres1", len(tbls))
+}
+
+// consumeFailback applies one postgres2 table's changes to postgres1, like
+// consumeAndWrite does in the forward direction.
+func consumeFailback(ctx, applyCtx context.Context, sink Sink, table string) {
+	topic := failback.topic(table)
+	log.Printf("  [failback] %s -> postgres1.%s", topic, table)
+	readTopic(ctx, topic, resumeOffset(applyCtx, topic, pgCheckpoints(failbackDSN())), func(msgs []kafka.Message) {
+		batch, pos, ok := retryPrepare(applyCtx, table, func() ([]changeEvent, position, error) {
+			return prepareFailback(applyCtx, topic, table, msgs)
+		})
+		if !ok {
+			return
+		}
+		applyBatch(applyCtx, sink, table, batch, pos)
+	})
+	log.Printf("  [failback] %s stopped", topic)
+}
+
+// prepareFailback decodes postgres2 changes into postgres1 events: writer
+// columns are stripped and the writer's own forward writes are dropped. A
+// failed echo lookup is returned so the batch is retried.
+func prepareFailback(ctx context.Context, topic, table string, msgs []kafka.Message) ([]changeEvent, position, error) {
+	batch := make([]changeEvent, 0, len(msgs))
+	var lsn int64 // source position of the last decoded event
+	for _, m := range msgs {
+		e, err := decodeEvent(table, m.Value)
+		if err != nil {
+			continue
+		}
+		e.Site, e.Topic, e.Offset = failback.Site, topic, m.Offset
+		lsn = e.LSN
+		e.Schema, e.Target, e.Key = "public", table, sourceKey(table)
+		e.Before, e.After = sourceImage(e.Before), sourceImage(e.After)
+		batch = append(batch, e)
+	}
+	batch, err := dropEchoes(ctx, failback.dsn(), batch)
+	if err != nil {
+		return nil, position{}, err
+	}
+	last := msgs[len(msgs)-1]
+	// Filtered-out and echoed events count: their position is passed too,
+	// which lets origin tags be pruned behind it (see origin.go).
+	return batch, position{Topic: topic, Offset: last.Offset, LSN: lsn}, nil
+}
+
+// sourceImage removes the columns the writer adds on postgres2 from a row.
+func sourceImage(row map[string]interface{}) map[string]interface{} {
+	for k := range row {
+		if writerColumn(k) {
+			delete(row, k)
+		}
+	}
+	return row
+}
+
+// failbackSink applies postgres2 changes to postgres1.
+type failbackSink struct {
+	db       *sql.DB
+	fk       fkWaiter
+	commitTs bool // commit timestamps available for conflict resolution
+}
+
+// newFailbackSink connects to postgres1 and creates the origin, conflict and
+// checkpoint tables there.
+func newFailbackSink() (*failbackSink, error) {
+	db, err := sql.Open("postgres", failbackDSN())
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range []string{originDDL, conflictsDDL, checkpointsDDL} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &failbackSink{db: db, commitTs: commitTimestamps(db)}, nil
+}
+
+// Apply writes the batch in one origin-tagged transaction with a savepoint
+// per row, dead-lettering failed rows; foreign-key violations fail the batch
+// for retry like in the postgres2 sink.
+func (s *failbackSink) Apply(ctx context.Context, batch []changeEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tagOrigin(ctx, tx); err != nil {
+		return err
+	}
+	var dead deadLetters
+	for _, e := range batch {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT cdc_row"); err != nil {
+			return err
+		}
+		if err := s.applyEvent(ctx, tx, e); err != nil {
+			if isFKViolation(err) && s.fk.await(batch) {
+				return fmt.Errorf("%s %v: %w: %w", opName(e.Op), keyValues(e.Key, e.row()), errFKWait, err)
+			}
+			dead.add("failback", e, fmt.Errorf("%s: %w", opName(e.Op), err))
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT cdc_row"); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT cdc_row"); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dead.record(ctx)
+	s.fk.clear(batch)
+	return nil
+}
+
+// applyEvent resolves conflicts with changes made on postgres1 (see
+// conflict.go), then deletes or upserts the row there. Columns the forward
+// direction masks or projects away hold no source values on postgres2, so
+// they are written for new rows but never overwrite existing ones.
+func (s *failbackSink) applyEvent(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	if (e.Op == "d" && e.Before == nil) || (e.Op != "d" && e.After == nil) {
+		return nil
+	}
+	e, apply, err := resolveConflict(ctx, tx, e, s.commitTs)
+	if err != nil || !apply {
+		return err
+	}
+	if e.Op == "d" {
+		where, vals := keyWhere(e.Key, e.Before, 1)
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", qualifiedTarget(e), where), vals...)
+		if err == nil {
+			log.Printf("  [failback] deleted %s id=%v", e.Target, keyValues(e.Key, e.Before))
+		}
+		return err
+	}
+	cfg := configFor(e.Table)
+	var cols, phs, ups []string
+	var vals []interface{}
+	for k, v := range e.After {
+		vals = append(vals, v)
+		cols = append(cols, quoteIdent(k))
+		phs = append(phs, fmt.Sprintf("$%d", len(vals)))
+		_, masked := cfg.Mask[k]
+		if expr, ok := e.Merge[k]; ok {
+			ups = append(ups, fmt.Sprintf("%s=%s", quoteIdent(k), expr))
+		} else if !contains(e.Key, k) && !masked && keepsColumn(e.Table, k) {
+			ups = append(ups, fmt.Sprintf("%s=EXCLUDED.%s", quoteIdent(k), quoteIdent(k)))
+		}
+	}
+	action := "DO NOTHING"
+	if len(ups) > 0 {
+		action = "DO UPDATE SET " + strings.Join(ups, ",")
+	}
+	q := fmt.Sprintf("INSERT INTO %s AS _t (%s) VALUES (%s) ON CONFLICT (%s) %s",
+		qualifiedTarget(e), strings.Join(cols, ","), strings.Join(phs, ","), quoteIdents(e.Key), action)
+	_, err = tx.ExecContext(ctx, q, vals...)
+	if err == nil {
+		log.Printf("  [failback] synced %s id=%v", e.Target, keyValues(e.Key, e.After))
+	}
+	return err
+}
+
+// Flush is a no-op: every Apply commits before returning.
+func (s *failbackSink) Flush(ctx context.Context) error { return nil }
+
+// Checkpoint records the position in postgres1's _cdc_checkpoints.
+func (s *failbackSink) Checkpoint(ctx context.Context, pos position) error {
+	return saveCheckpoint(ctx, s.db, pos)
+}
+
+// Close closes the connection pool.
+func (s *failbackSink) Close() error { return s.db.Close() }
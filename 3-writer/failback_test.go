@@ -0,0 +1,40 @@
+// failback_test.go — Tests for the failback table selection and row images.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSourceImage(t *testing.T) {
+	tests := []struct {
+		name string
+		row  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{"nil image", nil, nil},
+		{"writer columns stripped",
+			map[string]interface{}{"id": float64(7), "name": "r750", "_cdc_lsn": float64(900), "_cdc_op": "u",
+				"_deleted": false, "_deleted_at": nil, siteColumn: "site1"},
+			map[string]interface{}{"id": float64(7), "name": "r750"}},
+		{"source columns kept", map[string]interface{}{"id": float64(7), "cdc_note": "x"},
+			map[string]interface{}{"id": float64(7), "cdc_note": "x"}},
+	}
+	for _, tt := range tests {
+		if got := sourceImage(tt.row); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sourceImage = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFailbackTablesSkipMapped(t *testing.T) {
+	oldTables := tables
+	t.Cleanup(func() { tables = oldTables })
+	tables = []string{"failback_plain", "failback_renamed", "failback_moved"}
+	withTableConfig(t, "failback_renamed", tableConfig{Rename: map[string]string{"id": "device_id"}})
+	withTableConfig(t, "failback_moved", tableConfig{Target: "inventory.hosts"})
+
+	if got, want := failbackTables(), []string{"failback_plain"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("failbackTables = %v, want %v", got, want)
+	}
+}
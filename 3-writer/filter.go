@@ -0,0 +1,384 @@
+// filter.go — Declarative row filtering and column projection per table.
+// Rules come from tableConfig.Where/Include/Exclude and run in the consumer
+// before any sink sees the event. Updates that move a row into or out of the
+// filter are converted to inserts or deletes so the target stays consistent.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// predicate is one condition on a column of a row image. Values are compared
+// as text (the JSON value rendered with maskText, matching PostgreSQL's
+// ::text output for numbers, booleans and strings).
+//
+// Ops:
+//
+//	eq, ne             column equals / differs from Values[0] (NULL-safe)
+//	in, not_in         column is / is not one of Values
+//	null, not_null     column is / is not NULL
+//	lt, le, gt, ge     numeric comparison with Values[0]
+//	in_query,          column is / is not in the single-column result of the
+//	not_in_query       SQL in Values[0], run against the source and cached
+//	                   for filterLookupTTL (also when the restored dump is
+//	                   filtered, see applyFiltersToTarget)
+type predicate struct {
+	Column string
+	Op     string
+	Values []string
+}
+
+// filterEvent applies the table's Where rules and column projection to an
+// event. It returns false when the event should be dropped, and an error
+// when a lookup predicate cannot be evaluated (the batch is then retried).
+//
+// Update handling (before image known / unknown):
+//
+//	before in,  after in  → update
+//	before out, after in  → insert
+//	before in,  after out → delete
+//	before out, after out → dropped
+//
+// Without a full before image (REPLICA IDENTITY DEFAULT) the before side is
+// unknown and treated as "in": the upsert or delete is idempotent either way.
+func filterEvent(ctx context.Context, e changeEvent) (changeEvent, bool, error) {
+	cfg := configFor(e.Table)
+	dsn := sourceFor(e.Site).dsn()
+	if len(cfg.Where) > 0 {
+		switch e.Op {
+		case "c", "r":
+			in, _, err := rowMatches(ctx, dsn, cfg.Where, e.After)
+			if err != nil || !in {
+				return e, false, err
+			}
+		case "d":
+			in, known, err := rowMatches(ctx, dsn, cfg.Where, e.Before)
+			if err != nil || known && !in {
+				return e, false, err
+			}
+		case "u":
+			afterIn, _, err := rowMatches(ctx, dsn, cfg.Where, e.After)
+			if err != nil {
+				return e, false, err
+			}
+			beforeIn, known, err := rowMatches(ctx, dsn, cfg.Where, e.Before)
+			if err != nil {
+				return e, false, err
+			}
+			if !known {
+				beforeIn = true
+			}
+			switch {
+			case afterIn && !beforeIn:
+				e.Op = "c"
+			case !afterIn && beforeIn:
+				e.Op = "d"
+				if e.Before == nil {
+					e.Before = e.After // after carries the key
+				}
+				e.After = nil
+			case !afterIn && !beforeIn:
+				return e, false, nil
+			}
+		}
+	}
+	if len(cfg.Include) > 0 || len(cfg.Exclude) > 0 {
+		e.Before = projectRow(e.Table, e.Before)
+		e.After = projectRow(e.Table, e.After)
+	}
+	return e, true, nil
+}
+
+// rowMatches evaluates all predicates against a row; lookups run against the
+// source at dsn. known is false when the row is nil or lacks a referenced
+// column (e.g. a key-only before image). A failed lookup is returned as err.
+func rowMatches(ctx context.Context, dsn string, preds []predicate, row map[string]interface{}) (match, known bool, err error) {
+	if row == nil {
+		return false, false, nil
+	}
+	for _, p := range preds {
+		v, ok := row[p.Column]
+		if !ok {
+			return false, false, nil
+		}
+		if ok, err := p.eval(ctx, dsn, v); err != nil || !ok {
+			return false, true, err
+		}
+	}
+	return true, true, nil
+}
+
+// eval reports whether the predicate holds for value v. Lookup predicates
+// fail with the query's error rather than guessing from a missing set.
+func (p predicate) eval(ctx context.Context, dsn string, v interface{}) (bool, error) {
+	arg := ""
+	if len(p.Values) > 0 {
+		arg = p.Values[0]
+	}
+	s := maskText(v)
+	switch p.Op {
+	case "eq":
+		return v != nil && s == arg, nil
+	case "ne":
+		return v == nil || s != arg, nil
+	case "in":
+		return v != nil && contains(p.Values, s), nil
+	case "not_in":
+		return v == nil || !contains(p.Values, s), nil
+	case "null":
+		return v == nil, nil
+	case "not_null":
+		return v != nil, nil
+	case "lt", "le", "gt", "ge":
+		a, err1 := strconv.ParseFloat(s, 64)
+		b, err2 := strconv.ParseFloat(arg, 64)
+		if v == nil || err1 != nil || err2 != nil {
+			return false, nil
+		}
+		switch p.Op {
+		case "lt":
+			return a < b, nil
+		case "le":
+			return a <= b, nil
+		case "gt":
+			return a > b, nil
+		}
+		return a >= b, nil
+	case "in_query", "not_in_query":
+		set, err := lookupSet(ctx, dsn, arg)
+		if err != nil && set == nil {
+			return false, fmt.Errorf("lookup for %s: %w", p.Column, err)
+		}
+		if p.Op == "in_query" {
+			return v != nil && set[s], nil
+		}
+		return v == nil || !set[s], nil
+	}
+	log.Printf("  [filter] unknown predicate op %q on %s", p.Op, p.Column)
+	return true, nil
+}
+
+// projectRow applies a table's Include/Exclude to a row image.
+func projectRow(table string, row map[string]interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		if keepsColumn(table, k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// keepsColumn reports whether projection keeps a column of a source table.
+// The primary key (from the catalog, see sourceKey) and the site column are
+// always kept so sinks can address the row.
+func keepsColumn(table, col string) bool {
+	cfg := configFor(table)
+	if len(cfg.Include) == 0 && len(cfg.Exclude) == 0 {
+		return true
+	}
+	if col == siteColumn || contains(sourceKey(table), col) {
+		return true
+	}
+	if len(cfg.Include) > 0 && !contains(cfg.Include, col) {
+		return false
+	}
+	return !contains(cfg.Exclude, col)
+}
+
+// ═══════════════════════════════════════════════════════════════
+// LOOKUP PREDICATES
+// ═══════════════════════════════════════════════════════════════
+
+// lookupCache holds in_query results per source DSN and SQL text.
+var (
+	lookupCache   = make(map[string]lookupEntry)
+	lookupCacheMu sync.Mutex
+	lookupDBs     = make(map[string]*sql.DB)
+)
+
+type lookupEntry struct {
+	set     map[string]bool
+	fetched time.Time
+}
+
+// lookupSet returns the result of a lookup query as a set, refreshing it from
+// the source at dsn when older than filterLookupTTL. On query errors the
+// previous result (nil if there is none) is returned with the error. The
+// cache lock is not held while the query runs.
+func lookupSet(ctx context.Context, dsn, query string) (map[string]bool, error) {
+	ck := dsn + "\x00" + query
+	lookupCacheMu.Lock()
+	ent, ok := lookupCache[ck]
+	db := lookupDBs[dsn]
+	if db == nil {
+		var err error
+		if db, err = sql.Open("postgres", dsn); err != nil {
+			lookupCacheMu.Unlock()
+			return ent.set, err
+		}
+		lookupDBs[dsn] = db
+	}
+	lookupCacheMu.Unlock()
+	if ok && time.Since(ent.fetched) < filterLookupTTL {
+		return ent.set, nil
+	}
+
+	set, err := fetchLookup(ctx, db, query)
+	if err != nil {
+		log.Printf("  [filter] lookup %q: %v", query, err)
+		return ent.set, err
+	}
+	lookupCacheMu.Lock()
+	lookupCache[ck] = lookupEntry{set: set, fetched: time.Now()}
+	lookupCacheMu.Unlock()
+	return set, nil
+}
+
+// fetchLookup runs a lookup query and collects its non-NULL values as text.
+func fetchLookup(ctx context.Context, db *sql.DB, query string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := make(map[string]bool)
+	for rows.Next() {
+		var s sql.NullString
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		if s.Valid {
+			set[s.String] = true
+		}
+	}
+	return set, rows.Err()
+}
+
+// ═══════════════════════════════════════════════════════════════
+// BOOTSTRAP ALIGNMENT
+// ═══════════════════════════════════════════════════════════════
+
+// applyFiltersToTarget makes the restored dump of src agree with the filter
+// rules: rows failing Where are deleted and projected-away columns are set to
+// NULL. Lookup predicates are evaluated against src, as in the stream. Call
+// after pg_restore and before the consumers start.
+func applyFiltersToTarget(ctx context.Context, dsn string, src source) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Printf("  [filter] %v", err)
+		return
+	}
+	defer db.Close()
+
+	for _, t := range tables {
+		cfg := configFor(t)
+		if len(cfg.Where) > 0 {
+			cond, args, err := predicatesSQL(ctx, src.dsn(), cfg.Where)
+			if err != nil {
+				log.Printf("  [filter] %s: %v; restored rows left unfiltered", t, err)
+				continue
+			}
+			res, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE NOT (%s)", quoteIdent(t), cond), args...)
+			if err != nil {
+				log.Printf("  [filter] %s: %v", t, err)
+			} else {
+				n, _ := res.RowsAffected()
+				log.Printf("  [filter] %s: removed %d rows outside filter", t, n)
+			}
+		}
+		if len(cfg.Include) == 0 && len(cfg.Exclude) == 0 {
+			continue
+		}
+		ts, err := loadTableSchema(ctx, db, "public", t)
+		if err != nil {
+			log.Printf("  [filter] %s: %v", t, err)
+			continue
+		}
+		var sets []string
+		for _, c := range ts.Columns {
+			if keepsColumn(t, c.Name) {
+				continue
+			}
+			if c.NotNull {
+				log.Printf("  [filter] %s.%s is NOT NULL, keeping restored values", t, c.Name)
+				continue
+			}
+			sets = append(sets, quoteIdent(c.Name)+"=NULL")
+		}
+		if len(sets) > 0 {
+			if _, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s", quoteIdent(t), strings.Join(sets, ","))); err != nil {
+				log.Printf("  [filter] %s: %v", t, err)
+			} else {
+				log.Printf("  [filter] %s: cleared %d projected-away columns", t, len(sets))
+			}
+		}
+	}
+}
+
+// predicatesSQL renders predicates as a NULL-safe SQL condition with the
+// same semantics as predicate.eval. Lookup queries are run against the
+// source at dsn (lookupSet) and their result bound as a parameter, so the
+// condition can be evaluated on any database.
+func predicatesSQL(ctx context.Context, dsn string, preds []predicate) (string, []interface{}, error) {
+	var parts []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	for _, p := range preds {
+		col := quoteIdent(p.Column)
+		first := ""
+		if len(p.Values) > 0 {
+			first = p.Values[0]
+		}
+		var c string
+		switch p.Op {
+		case "eq":
+			c = fmt.Sprintf("%s::text = %s", col, arg(first))
+		case "ne":
+			c = fmt.Sprintf("%s::text IS DISTINCT FROM %s", col, arg(first))
+		case "in":
+			c = fmt.Sprintf("%s::text = ANY(string_to_array(%s, E'\\x1f'))", col, arg(strings.Join(p.Values, "\x1f")))
+		case "not_in":
+			c = fmt.Sprintf("%s IS NULL OR NOT (%s::text = ANY(string_to_array(%s, E'\\x1f')))", col, col, arg(strings.Join(p.Values, "\x1f")))
+		case "null":
+			c = col + " IS NULL"
+		case "not_null":
+			c = col + " IS NOT NULL"
+		case "lt", "le", "gt", "ge":
+			op := map[string]string{"lt": "<", "le": "<=", "gt": ">", "ge": ">="}[p.Op]
+			c = fmt.Sprintf("%s::numeric %s %s::numeric", col, op, arg(first))
+		case "in_query", "not_in_query":
+			set, err := lookupSet(ctx, dsn, first)
+			if err != nil {
+				return "", nil, fmt.Errorf("lookup %q: %w", first, err)
+			}
+			vals := make([]string, 0, len(set))
+			for v := range set {
+				vals = append(vals, v)
+			}
+			c = fmt.Sprintf("%s::text = ANY(%s::text[])", col, arg(pq.Array(vals)))
+			if p.Op == "not_in_query" {
+				c = fmt.Sprintf("%s IS NULL OR NOT (%s)", col, c)
+			}
+		default:
+			c = "true"
+		}
+		parts = append(parts, "COALESCE(("+c+"), false)")
+	}
+	return strings.Join(parts, " AND "), args, nil
+}
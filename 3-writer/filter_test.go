@@ -0,0 +1,165 @@
+// filter_test.go — Tests for row filters, update transitions and projection.
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// withTableConfig installs cfg for table for the duration of a test.
+func withTableConfig(t *testing.T, table string, cfg tableConfig) {
+	t.Helper()
+	old, had := tableConfigs[table]
+	tableConfigs[table] = cfg
+	t.Cleanup(func() {
+		if had {
+			tableConfigs[table] = old
+		} else {
+			delete(tableConfigs, table)
+		}
+	})
+}
+
+func TestFilterEventTransitions(t *testing.T) {
+	withTableConfig(t, "filter_t", tableConfig{
+		Where: []predicate{{Column: "severity", Op: "in", Values: []string{"Critical", "Warning"}}},
+	})
+	in := map[string]interface{}{"id": float64(1), "severity": "Critical"}
+	out := map[string]interface{}{"id": float64(1), "severity": "Info"}
+	keyOnly := map[string]interface{}{"id": float64(1)}
+
+	tests := []struct {
+		name          string
+		op            string
+		before, after map[string]interface{}
+		wantKeep      bool
+		wantOp        string
+	}{
+		{"insert in", "c", nil, in, true, "c"},
+		{"insert out", "c", nil, out, false, ""},
+		{"snapshot read out", "r", nil, out, false, ""},
+		{"delete in", "d", in, nil, true, "d"},
+		{"delete out", "d", out, nil, false, ""},
+		{"delete key-only before", "d", keyOnly, nil, true, "d"},
+		{"update in to in", "u", in, in, true, "u"},
+		{"update out to in", "u", out, in, true, "c"},
+		{"update in to out", "u", in, out, true, "d"},
+		{"update out to out", "u", out, out, false, ""},
+		{"update unknown before to in", "u", nil, in, true, "u"},
+		{"update unknown before to out", "u", nil, out, true, "d"},
+		{"update key-only before to out", "u", keyOnly, out, true, "d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := changeEvent{Table: "filter_t", Site: sources[0].Site, Op: tt.op, Before: tt.before, After: tt.after}
+			got, keep, err := filterEvent(context.Background(), e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep != tt.wantKeep {
+				t.Fatalf("keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if !keep {
+				return
+			}
+			if got.Op != tt.wantOp {
+				t.Errorf("op = %q, want %q", got.Op, tt.wantOp)
+			}
+			if got.Op == "d" && (got.After != nil || got.Before == nil) {
+				t.Errorf("delete images: before=%v after=%v", got.Before, got.After)
+			}
+		})
+	}
+}
+
+func TestPredicateEval(t *testing.T) {
+	tests := []struct {
+		p    predicate
+		v    interface{}
+		want bool
+	}{
+		{predicate{Op: "eq", Values: []string{"5"}}, float64(5), true},
+		{predicate{Op: "eq", Values: []string{"5"}}, nil, false},
+		{predicate{Op: "eq", Values: []string{"1000000"}}, float64(1000000), true},
+		{predicate{Op: "in", Values: []string{"2500000", "7"}}, float64(2500000), true},
+		{predicate{Op: "not_in", Values: []string{"1000000"}}, float64(1000000), false},
+		{predicate{Op: "eq", Values: []string{"0.000001"}}, float64(0.000001), true},
+		{predicate{Op: "eq", Values: []string{"true"}}, true, true},
+		{predicate{Op: "ne", Values: []string{"5"}}, nil, true},
+		{predicate{Op: "in", Values: []string{"a", "b"}}, "b", true},
+		{predicate{Op: "not_in", Values: []string{"a", "b"}}, "c", true},
+		{predicate{Op: "null"}, nil, true},
+		{predicate{Op: "not_null"}, false, true},
+		{predicate{Op: "lt", Values: []string{"10"}}, float64(9.5), true},
+		{predicate{Op: "ge", Values: []string{"10"}}, "10", true},
+		{predicate{Op: "gt", Values: []string{"10"}}, "abc", false},
+		{predicate{Op: "le", Values: []string{"10"}}, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := tt.p.eval(context.Background(), "", tt.v)
+		if err != nil || got != tt.want {
+			t.Errorf("%s %v on %v = %v, %v, want %v", tt.p.Op, tt.p.Values, tt.v, got, err, tt.want)
+		}
+	}
+}
+
+func TestPredicateLookupErrors(t *testing.T) {
+	const dsn = "postgres://writer@127.0.0.1:1/omedb?sslmode=disable&connect_timeout=1"
+	const stale = "SELECT id FROM stale_lookup"
+	lookupCacheMu.Lock()
+	lookupCache[dsn+"\x00"+stale] = lookupEntry{set: map[string]bool{"1000000": true}}
+	lookupCacheMu.Unlock()
+	t.Cleanup(func() {
+		lookupCacheMu.Lock()
+		delete(lookupCache, dsn+"\x00"+stale)
+		lookupCacheMu.Unlock()
+	})
+
+	tests := []struct {
+		name    string
+		p       predicate
+		want    bool
+		wantErr bool
+	}{
+		{"no cached set", predicate{Column: "id", Op: "in_query", Values: []string{"SELECT id FROM missing"}}, false, true},
+		{"no cached set, negated", predicate{Column: "id", Op: "not_in_query", Values: []string{"SELECT id FROM missing"}}, false, true},
+		{"stale set kept", predicate{Column: "id", Op: "in_query", Values: []string{stale}}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.eval(context.Background(), dsn, float64(1000000))
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("eval = %v, %v, want %v (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeepsColumnKeepsCatalogKey(t *testing.T) {
+	withTableConfig(t, "filter_k", tableConfig{Include: []string{"name"}})
+	sourceKeysMu.Lock()
+	sourceKeys["filter_k"] = []string{"tenant", "serial"}
+	sourceKeysMu.Unlock()
+	t.Cleanup(func() {
+		sourceKeysMu.Lock()
+		delete(sourceKeys, "filter_k")
+		sourceKeysMu.Unlock()
+	})
+
+	tests := []struct {
+		col  string
+		want bool
+	}{
+		{"name", true},
+		{"tenant", true},
+		{"serial", true},
+		{siteColumn, true},
+		{"id", false},
+		{"notes", false},
+	}
+	for _, tt := range tests {
+		if got := keepsColumn("filter_k", tt.col); got != tt.want {
+			t.Errorf("keepsColumn(%q) = %v, want %v", tt.col, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// fkgraph.go — Foreign-key dependency graph of the target tables.
+// Table consumers run independently, so a child row (alerts) can reach
+// postgres2 before the parent it references (a brand-new device). The graph
+// is read from the target catalog and used to start work parents-first; the
+// postgres2 sink retries batches that still hit a foreign-key violation
+// until the parent arrives or fkRetryTimeout passes (see sink_postgres.go).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fkGraph maps a replicated source table to the replicated tables its
+// target references.
+type fkGraph map[string][]string
+
+// loadFKGraph reads the foreign keys between replicated target tables from
+// the target catalog. Self-references (groups.parent_group_id) are omitted.
+func loadFKGraph(ctx context.Context, dsn string) (fkGraph, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	byTarget := make(map[string]string, len(tables))
+	for _, t := range tables {
+		schema, name := targetOf(t)
+		byTarget[schema+"."+name] = t
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT cn.nspname, cl.relname, rn.nspname, rf.relname
+		FROM pg_constraint c
+		JOIN pg_class cl ON cl.oid = c.conrelid JOIN pg_namespace cn ON cn.oid = cl.relnamespace
+		JOIN pg_class rf ON rf.oid = c.confrelid JOIN pg_namespace rn ON rn.oid = rf.relnamespace
+		WHERE c.contype = 'f'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	g := make(fkGraph)
+	for rows.Next() {
+		var cs, cr, rs, rr string
+		if err := rows.Scan(&cs, &cr, &rs, &rr); err != nil {
+			return nil, err
+		}
+		child, ok1 := byTarget[cs+"."+cr]
+		parent, ok2 := byTarget[rs+"."+rr]
+		if ok1 && ok2 && child != parent && !contains(g[child], parent) {
+			g[child] = append(g[child], parent)
+		}
+	}
+	return g, rows.Err()
+}
+
+// order returns tables parents-first, keeping the relative order of `tables`
+// among independent tables. A foreign-key cycle is broken at its first listed
+// table; tables referencing the cycle still follow it.
+func (g fkGraph) order(tables []string) []string {
+	done := make(map[string]bool, len(tables))
+	var out []string
+	for len(out) < len(tables) {
+		progressed := false
+		for _, t := range tables {
+			if !done[t] && g.ready(t, tables, done) {
+				done[t] = true
+				out = append(out, t)
+				progressed = true
+			}
+		}
+		if !progressed {
+			for _, t := range tables {
+				if !done[t] && g.reaches(t, t, tables, done, map[string]bool{}) {
+					log.Printf("  [fk] %s is on a foreign-key cycle, ordering it as listed", t)
+					done[t] = true
+					out = append(out, t)
+					break
+				}
+			}
+		}
+	}
+	return out
+}
+
+// ready reports whether every replicated parent of t is already ordered.
+func (g fkGraph) ready(t string, tables []string, done map[string]bool) bool {
+	for _, p := range g[t] {
+		if !done[p] && contains(tables, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// reaches reports whether target is reachable from t through parents not
+// ordered yet.
+func (g fkGraph) reaches(t, target string, tables []string, done, seen map[string]bool) bool {
+	for _, p := range g[t] {
+		if done[p] || !contains(tables, p) || seen[p] {
+			continue
+		}
+		if p == target {
+			return true
+		}
+		seen[p] = true
+		if g.reaches(p, target, tables, done, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOrder loads the FK graph of the target and returns the replicated
+// tables parents-first, falling back to `tables` when the catalog is
+// unreadable.
+func applyOrder(ctx context.Context, dsn string) []string {
+	g, err := loadFKGraph(ctx, dsn)
+	if err != nil {
+		log.Printf("  [fk] %v; using configured table order", err)
+		return tables
+	}
+	for _, t := range tables {
+		if len(g[t]) > 0 {
+			log.Printf("  [fk] %s → %s", t, strings.Join(g[t], ","))
+		}
+	}
+	return g.order(tables)
+}
+
+// isFKViolation reports whether err is a PostgreSQL foreign_key_violation.
+func isFKViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// fkWaiter tracks, per pending batch, since when it has been failing on a
+// foreign-key violation. Batches are told apart by fkWaitKey, so one
+// worker's or source's commit does not restart another's wait.
+type fkWaiter struct {
+	mu    sync.Mutex
+	first map[string]time.Time // fkWaitKey → first FK violation of the batch
+}
+
+// fkWaitKey identifies a batch by its topic, table and first event's
+// position; a retried batch starts with the same event. The topic keeps
+// sources sharing a target table apart.
+func fkWaitKey(batch []changeEvent) string {
+	e := batch[0]
+	return fmt.Sprintf("%s/%s/%d/%d", e.Topic, e.Table, e.Offset, e.LSN)
+}
+
+// await reports whether a batch that hit a foreign-key violation should
+// still be retried, i.e. fkRetryTimeout has not passed since its first
+// violation.
+func (w *fkWaiter) await(batch []changeEvent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.first == nil {
+		w.first = make(map[string]time.Time)
+	}
+	k := fkWaitKey(batch)
+	first, ok := w.first[k]
+	if !ok {
+		w.first[k] = time.Now()
+		return true
+	}
+	return time.Since(first) < fkRetryTimeout
+}
+
+// clear forgets a batch's violations once it committed.
+func (w *fkWaiter) clear(batch []changeEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.first, fkWaitKey(batch))
+}
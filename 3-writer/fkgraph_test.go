@@ -0,0 +1,98 @@
+// fkgraph_test.go — Tests for the parents-first table order and FK waits.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestFKGraphOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		g      fkGraph
+		tables []string
+		want   []string
+	}{
+		{"independent keep list order", fkGraph{},
+			[]string{"b", "a", "c"}, []string{"b", "a", "c"}},
+		{"child listed first", fkGraph{"alerts": {"devices"}},
+			[]string{"alerts", "devices"}, []string{"devices", "alerts"}},
+		{"chain", fkGraph{"c": {"b"}, "b": {"a"}},
+			[]string{"c", "b", "a"}, []string{"a", "b", "c"}},
+		{"diamond", fkGraph{"d": {"b", "c"}, "b": {"a"}, "c": {"a"}},
+			[]string{"d", "c", "b", "a"}, []string{"a", "c", "b", "d"}},
+		{"parent not replicated", fkGraph{"alerts": {"devices"}},
+			[]string{"alerts"}, []string{"alerts"}},
+		{"cycle appended in list order", fkGraph{"x": {"y"}, "y": {"x"}, "z": {"a"}},
+			[]string{"x", "z", "y", "a"}, []string{"a", "z", "x", "y"}},
+		{"child of a cycle after its parent", fkGraph{"x": {"y"}, "y": {"x"}, "c": {"x"}},
+			[]string{"c", "x", "y"}, []string{"x", "c", "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.g.order(tt.tables); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order(%v) = %v, want %v", tt.tables, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFKViolation(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "23503"}, true},
+		{fmt.Errorf("apply: %w", &pq.Error{Code: "23503"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.New("23503"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isFKViolation(tt.err); got != tt.want {
+			t.Errorf("isFKViolation(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFKWaiterPerBatch(t *testing.T) {
+	expired := time.Now().Add(-fkRetryTimeout - time.Second)
+	a := []changeEvent{{Topic: "site1.public.alerts", Table: "alerts", Offset: 10, LSN: 100}}
+	b := []changeEvent{{Topic: "site1.public.alerts", Table: "alerts", Offset: 20, LSN: 200}}
+	c := []changeEvent{{Table: "devices", Offset: 10, LSN: 100}}
+	site2 := []changeEvent{{Topic: "site2.public.alerts", Table: "alerts", Offset: 10, LSN: 100}}
+
+	tests := []struct {
+		name    string
+		cleared [][]changeEvent
+		want    bool // whether a is still retried
+	}{
+		{"expired wait", nil, false},
+		{"other batch of the table committed", [][]changeEvent{b}, false},
+		{"other table committed", [][]changeEvent{c}, false},
+		{"other source committed at the same offset", [][]changeEvent{site2}, false},
+		{"the batch itself committed", [][]changeEvent{a}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w fkWaiter
+			w.await(a)
+			w.await(b)
+			w.first[fkWaitKey(a)] = expired
+			for _, batch := range tt.cleared {
+				w.clear(batch)
+			}
+			if got := w.await(a); got != tt.want {
+				t.Errorf("await = %v, want %v", got, tt.want)
+			}
+			if !w.await(b) {
+				t.Errorf("fresh wait of another batch expired")
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// history.go — SCD Type-2 history tables maintained by the postgres2 sink.
+// For tables with tableConfig.History the sink keeps a companion
+// <target>_history next to the target: one row per version with valid_from
+// and valid_to taken from source commit times, and _lsn, the source LSN of
+// the change that opened it. valid_to IS NULL marks the current version.
+// Versions are ordered by LSN, so two changes committed in the same
+// millisecond still yield two versions. Writes happen in the same
+// transaction (and savepoint) as the target row, so history and current
+// state never disagree.
+//
+// Point-in-time query:
+//
+//	SELECT * FROM devices_history
+//	WHERE valid_from <= $t AND (valid_to IS NULL OR valid_to > $t);
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// historyTable returns the quoted history table of an event's target.
+func historyTable(e changeEvent) string {
+	return quoteIdent(e.Schema) + "." + quoteIdent(e.Target+"_history")
+}
+
+// ensureHistory creates the history table from the source schema (all
+// columns nullable, plus version bookkeeping) and, when it is new, seeds one
+// open version per current target row, valid from now.
+func (s *postgresSink) ensureHistory(ctx context.Context, e changeEvent) error {
+	cat, err := catalogFor(e.Table)
+	if err != nil {
+		return err
+	}
+	ts, err := targetTableSchema(ctx, cat, e.Table)
+	if err != nil {
+		return err
+	}
+	hist := historyTable(e)
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", hist).Scan(&exists); err != nil {
+		return err
+	}
+
+	defs := []string{"_version_id BIGSERIAL PRIMARY KEY", "valid_from TIMESTAMPTZ NOT NULL",
+		"valid_to TIMESTAMPTZ", "_op CHAR(1) NOT NULL", "_lsn BIGINT"}
+	var cols []string
+	for _, c := range ts.Columns {
+		defs = append(defs, quoteIdent(c.Name)+" "+c.Type)
+		cols = append(cols, quoteIdent(c.Name))
+	}
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", hist, strings.Join(defs, ", ")),
+		fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s) WHERE valid_to IS NULL",
+			quoteIdent(e.Target+"_history_current"), hist, quoteIdents(ts.Key)),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s, valid_from)",
+			quoteIdent(e.Target+"_history_key"), hist, quoteIdents(ts.Key)),
+	}
+	stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS _lsn BIGINT", hist))
+	for _, c := range ts.Columns {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", hist, quoteIdent(c.Name), c.Type))
+	}
+	for _, q := range stmts {
+		if _, err := s.db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	if exists {
+		return nil
+	}
+
+	where := ""
+	if configFor(e.Table).SoftDelete {
+		where = " WHERE NOT _deleted"
+	}
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (valid_from, _op, %s) SELECT NOW(), 'r', %s FROM %s%s",
+		hist, strings.Join(cols, ","), strings.Join(cols, ","), qualifiedTarget(e), where))
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	log.Printf("  [history] created %s, seeded %d current versions", hist, n)
+	return nil
+}
+
+// recordHistory closes the key's open version and opens a new one for
+// inserts and updates, or only closes it for deletes.
+//
+// Updates that leave every tracked column (HistoryColumns, or all columns)
+// unchanged keep the open version. Events whose LSN is not past the open
+// version's (replays after a retry or restart) change nothing, so history
+// stays idempotent under at-least-once delivery. Versions seeded from
+// restored rows have no LSN and are compared by time.
+func (s *postgresSink) recordHistory(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	hist := historyTable(e)
+	at := sourceTime(e.TsMs)
+	const older = `(_lsn < $2 OR _lsn IS NULL AND valid_from <= COALESCE($1::timestamptz, NOW()))`
+	if e.Op == "d" {
+		where, vals := keyWhere(e.Key, e.Before, 3)
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET valid_to=COALESCE($1::timestamptz, NOW())
+			WHERE %s AND valid_to IS NULL AND %s`, hist, where, older),
+			append([]interface{}{at, e.LSN}, vals...)...)
+		return err
+	}
+
+	tracked := configFor(e.Table).HistoryColumns
+	if len(tracked) == 0 {
+		for k := range e.After {
+			if !contains(e.Key, k) {
+				tracked = append(tracked, k)
+			}
+		}
+	}
+	tsCols := s.timestampColumns(ctx, e.Schema, e.Target)
+	value := func(k string) interface{} {
+		if tsCols[k] {
+			return convertTimestamp(e.After[k])
+		}
+		return e.After[k]
+	}
+
+	// Close the open version when a tracked column changed.
+	where, vals := keyWhere(e.Key, e.After, 3)
+	vals = append([]interface{}{at, e.LSN}, vals...)
+	var left, right []string
+	for _, k := range tracked {
+		if _, ok := e.After[k]; !ok {
+			continue
+		}
+		vals = append(vals, value(k))
+		left = append(left, quoteIdent(k))
+		right = append(right, fmt.Sprintf("$%d", len(vals)))
+	}
+	changed := "true"
+	if len(left) > 0 {
+		changed = fmt.Sprintf("ROW(%s) IS DISTINCT FROM ROW(%s)", strings.Join(left, ","), strings.Join(right, ","))
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET valid_to=COALESCE($1::timestamptz, NOW())
+		WHERE %s AND valid_to IS NULL AND %s AND %s`, hist, where, older, changed),
+		vals...); err != nil {
+		return err
+	}
+
+	// Open a new version unless one is still open.
+	var cols, phs []string
+	vals = []interface{}{at, e.Op, e.LSN}
+	for k := range e.After {
+		vals = append(vals, value(k))
+		cols = append(cols, quoteIdent(k))
+		phs = append(phs, fmt.Sprintf("$%d", len(vals)))
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (valid_from, _op, _lsn, %s)
+		VALUES (COALESCE($1::timestamptz, NOW()), $2, $3, %s)
+		ON CONFLICT (%s) WHERE valid_to IS NULL DO NOTHING`,
+		hist, strings.Join(cols, ","), strings.Join(phs, ","), quoteIdents(e.Key)), vals...)
+	return err
+}
@@ -0,0 +1,173 @@
+// keystate.go — Per-key LSN guard for the postgres2 sink.
+// Consumers restart from the first Kafka offset and the dump/WAL overlap is
+// replayed, so the same or older changes reach the sink again, including
+// changes an earlier bootstrap left in the topics. The guard records the last
+// applied source LSN of every key in _cdc_key_state and only lets a change
+// through when its LSN is not older. Deletes leave a tombstone (deleted=true
+// with the delete's LSN) so a replayed insert cannot resurrect the row, until
+// the checkpoints have moved past it and it is pruned.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// keyStateDDL creates the side table holding the guard state.
+const keyStateDDL = `CREATE TABLE IF NOT EXISTS _cdc_key_state (
+	target TEXT NOT NULL, key TEXT NOT NULL,
+	lsn BIGINT NOT NULL, deleted BOOLEAN NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (target, key))`
+
+// guardKeySQL advances a key's state unless it holds a newer change. Keys
+// without state are admitted when $5 (no bootstrap floor) is false, when the
+// LSN is above the last _cdc_bootstrap slot, or when state exists.
+const guardKeySQL = `INSERT INTO _cdc_key_state AS s (target, key, lsn, deleted)
+		SELECT $1, $2, $3::bigint, $4
+		WHERE NOT $5::boolean
+			OR $3::bigint > COALESCE((SELECT (slot_lsn::pg_lsn - '0/0'::pg_lsn)::bigint
+				FROM _cdc_bootstrap ORDER BY id DESC LIMIT 1), -1)
+			OR EXISTS (SELECT 1 FROM _cdc_key_state WHERE target = $1 AND key = $2)
+		ON CONFLICT (target, key) DO UPDATE SET lsn=EXCLUDED.lsn, deleted=EXCLUDED.deleted, updated_at=NOW()
+		WHERE s.lsn <= EXCLUDED.lsn`
+
+// guardKey advances the key's state to the event's LSN, returning errStale
+// when the key already holds a newer change. It runs inside the event's
+// savepoint, so a failed apply rolls the state back too.
+//
+// Keys without state hold whatever the bootstrap restored, so a change from
+// the dumped source must be newer than the slot the bootstrap started from
+// (the last _cdc_bootstrap slot_lsn). Older changes left in the topics by an
+// earlier bootstrap are stale. Keys of snapshot-copied sources have no such
+// floor; events without an LSN (snapshot copies) count as LSN 0.
+func (s *postgresSink) guardKey(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	args, err := guardKeyArgs(e)
+	if err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, guardKeySQL, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errStale
+	}
+	return nil
+}
+
+// guardKeyArgs returns the guardKeySQL arguments for an event: its target,
+// key as JSON, LSN, whether it leaves a tombstone and whether the bootstrap
+// floor applies (changes of the dumped source only).
+func guardKeyArgs(e changeEvent) ([]interface{}, error) {
+	key, err := json.Marshal(keyValues(e.Key, e.row()))
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{e.Schema + "." + e.Target, string(key), e.LSN, e.Op == "d", e.Site == sources[0].Site}, nil
+}
+
+// pruneLoop prunes tombstones hourly until the sink is closed.
+func (s *postgresSink) pruneLoop() {
+	defer close(s.done)
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if err := s.pruneTombstones(context.Background()); err != nil {
+				log.Printf("  [writer] prune tombstones: %v", err)
+			}
+		}
+	}
+}
+
+// pruneTombstones deletes the tombstones no replay can reach any more: older
+// than tombstoneRetention and below the checkpointed LSN of every topic
+// feeding their target (see tombstoneFloor).
+func (s *postgresSink) pruneTombstones(ctx context.Context) error {
+	for _, t := range tables {
+		topics := tombstoneTopics(t)
+		rows, err := s.db.QueryContext(ctx, "SELECT topic, lsn FROM _cdc_checkpoints WHERE topic = ANY($1)", pq.Array(topics))
+		if err != nil {
+			return err
+		}
+		lsns := make(map[string]int64)
+		for rows.Next() {
+			var topic string
+			var lsn int64
+			if err := rows.Scan(&topic, &lsn); err != nil {
+				rows.Close()
+				return err
+			}
+			lsns[topic] = lsn
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		floor, ok := tombstoneFloor(topics, lsns)
+		if !ok {
+			continue
+		}
+		e := mapEvent(changeEvent{Table: t})
+		res, err := s.db.ExecContext(ctx, `DELETE FROM _cdc_key_state
+			WHERE target = $1 AND deleted AND lsn < $2 AND updated_at < $3`,
+			e.Schema+"."+e.Target, floor, tombstoneCutoff(time.Now()))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("  [writer] pruned %d tombstones of %s", n, e.Target)
+		}
+	}
+	return nil
+}
+
+// tombstoneTopics lists the topics (slots in pgoutput mode) feeding a table.
+func tombstoneTopics(table string) []string {
+	var topics []string
+	for _, src := range sources {
+		if !contains(src.tableList(), table) {
+			continue
+		}
+		if sourceMode == "pgoutput" {
+			topics = append(topics, src.Slot)
+		} else {
+			topics = append(topics, src.topic(table))
+		}
+	}
+	return topics
+}
+
+// tombstoneFloor returns the LSN below which a table's tombstones can go:
+// the lowest checkpointed LSN of its topics. LSNs of different sources are
+// not comparable, so the lowest is used, which is below each of them. ok is
+// false while any topic has no checkpoint yet.
+func tombstoneFloor(topics []string, lsns map[string]int64) (floor int64, ok bool) {
+	if len(topics) == 0 {
+		return 0, false
+	}
+	for i, t := range topics {
+		lsn, found := lsns[t]
+		if !found {
+			return 0, false
+		}
+		if i == 0 || lsn < floor {
+			floor = lsn
+		}
+	}
+	return floor, true
+}
+
+// tombstoneCutoff is the newest update time of a prunable tombstone.
+func tombstoneCutoff(now time.Time) time.Time {
+	return now.Add(-tombstoneRetention)
+}
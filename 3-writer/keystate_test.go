@@ -0,0 +1,108 @@
+// keystate_test.go — Tests for the LSN guard's arguments and tombstone pruning bounds.
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGuardKeyArgs(t *testing.T) {
+	primary, copied := sources[0].Site, "site2"
+	tests := []struct {
+		name string
+		e    changeEvent
+		want []interface{}
+	}{
+		{"update from the dumped source", changeEvent{Site: primary, Op: "u", Schema: "public", Target: "devices",
+			Key: []string{"id"}, LSN: 500, After: map[string]interface{}{"id": float64(7), "name": "r750"}},
+			[]interface{}{"public.devices", "7", int64(500), false, true}},
+		{"delete leaves a tombstone", changeEvent{Site: primary, Op: "d", Schema: "public", Target: "devices",
+			Key: []string{"id"}, LSN: 600, Before: map[string]interface{}{"id": float64(7)}},
+			[]interface{}{"public.devices", "7", int64(600), true, true}},
+		{"mapped composite key", changeEvent{Site: primary, Op: "c", Schema: "inventory", Target: "hosts",
+			Key: []string{"tenant", "serial"}, LSN: 700, After: map[string]interface{}{"tenant": "a", "serial": "SN-1"}},
+			[]interface{}{"inventory.hosts", `["a","SN-1"]`, int64(700), false, true}},
+		{"snapshot-copied source has no floor", changeEvent{Site: copied, Op: "r", Schema: "public", Target: "devices",
+			Key: []string{siteColumn, "id"}, After: map[string]interface{}{siteColumn: copied, "id": float64(7)}},
+			[]interface{}{"public.devices", `["site2",7]`, int64(0), false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := guardKeyArgs(tt.e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTombstoneTopics(t *testing.T) {
+	oldSources, oldMode := sources, sourceMode
+	t.Cleanup(func() { sources, sourceMode = oldSources, oldMode })
+	sources = []source{
+		{Site: "site1", Slot: "slot1", TopicPrefix: "ome"},
+		{Site: "site2", Slot: "slot2", TopicPrefix: "ome_site2", Tables: []string{"devices"}},
+	}
+
+	tests := []struct {
+		mode, table string
+		want        []string
+	}{
+		{"kafka", "devices", []string{"ome.public.devices", "ome_site2.public.devices"}},
+		{"kafka", "alerts", []string{"ome.public.alerts"}},
+		{"pgoutput", "devices", []string{"slot1", "slot2"}},
+		{"pgoutput", "alerts", []string{"slot1"}},
+	}
+	for _, tt := range tests {
+		sourceMode = tt.mode
+		if got := tombstoneTopics(tt.table); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: topics = %v, want %v", tt.mode, tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestTombstoneFloor(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics []string
+		lsns   map[string]int64
+		want   int64
+		wantOK bool
+	}{
+		{"one topic", []string{"a"}, map[string]int64{"a": 900}, 900, true},
+		{"lowest of the sources", []string{"a", "b"}, map[string]int64{"a": 900, "b": 400}, 400, true},
+		{"first topic lowest", []string{"a", "b"}, map[string]int64{"a": 100, "b": 400}, 100, true},
+		{"topic not checkpointed", []string{"a", "b"}, map[string]int64{"a": 900}, 0, false},
+		{"other topics ignored", []string{"a"}, map[string]int64{"a": 900, "z": 1}, 900, true},
+		{"no topics", nil, map[string]int64{"a": 900}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tombstoneFloor(tt.topics, tt.lsns)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: floor = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestTombstoneCutoff(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cutoff := tombstoneCutoff(now)
+	tests := []struct {
+		name      string
+		updatedAt time.Time
+		prunable  bool
+	}{
+		{"just written", now, false},
+		{"inside retention", now.Add(-tombstoneRetention + time.Minute), false},
+		{"past retention", now.Add(-tombstoneRetention - time.Minute), true},
+	}
+	for _, tt := range tests {
+		if got := tt.updatedAt.Before(cutoff); got != tt.prunable {
+			t.Errorf("%s: prunable = %v, want %v", tt.name, got, tt.prunable)
+		}
+	}
+}
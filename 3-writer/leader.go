@@ -0,0 +1,128 @@
+// leader.go — Leader election for running several writer replicas.
+// In HA mode (WRITER_HA=true) replicas compete for a session-level advisory
+// lock on postgres2's admin database; the postgres database survives the
+// DROP DATABASE omedb of a bootstrap, so the lock does too. Only the holder
+// runs bootstrap, manages connectors and consumes. Standbys poll for the lock
+// every leaderPollInterval: when the leader dies its session ends, the lock
+// is released, and a standby takes over streaming from the checkpoints the
+// leader stored in postgres2 without bootstrapping again.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// leaderConn holds the session that owns the advisory lock. It must stay
+// open for as long as this replica leads.
+var leaderConn *sql.Conn
+
+// acquireLeadership blocks until this replica holds the leader lock, then
+// starts watching the lock's session.
+func acquireLeadership(ctx context.Context) {
+	host, _ := os.Hostname()
+	for {
+		db, err := sql.Open("postgres", pg2AdminDSN)
+		if err == nil {
+			conn, err := db.Conn(ctx)
+			if err == nil {
+				var ok bool
+				err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&ok)
+				if err == nil && ok {
+					leaderConn = conn
+					log.Printf("  [HA] %s is leader", host)
+					go watchLeadership(ctx, conn)
+					return
+				}
+				conn.Close()
+			}
+			db.Close()
+		}
+		if err != nil {
+			log.Printf("  [HA] lock attempt: %v", err)
+		}
+		time.Sleep(leaderPollInterval)
+	}
+}
+
+// watchLeadership pings the lock session. If it is lost the lock may already
+// belong to another replica, so this one exits at once rather than keep
+// writing; the container restarts it as a standby.
+func watchLeadership(ctx context.Context, conn *sql.Conn) {
+	for {
+		time.Sleep(leaderPollInterval)
+		pctx, cancel := context.WithTimeout(ctx, leaderPollInterval)
+		err := conn.PingContext(pctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("  [HA] leadership lost: %v", err)
+		}
+	}
+}
+
+// bootstrapped reports whether a previous leader completed the bootstrap
+// (slot, dump, restore, connectors) of the current postgres2 database.
+func bootstrapped(ctx context.Context) bool {
+	db, err := sql.Open("postgres", pg2DSN)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM _cdc_bootstrap").Scan(&n); err != nil {
+		return false
+	}
+	return n > 0
+}
+
+// bootstrapDDL creates the bootstrap marker table. The postgres2 sink also
+// reads the last slot_lsn as the LSN guard's floor (see keystate.go).
+const bootstrapDDL = `CREATE TABLE IF NOT EXISTS _cdc_bootstrap (
+	id BIGSERIAL PRIMARY KEY, slot_lsn TEXT NOT NULL, writer TEXT NOT NULL,
+	completed_at TIMESTAMPTZ NOT NULL DEFAULT NOW())`
+
+// markBootstrapped records the completed bootstrap in postgres2 so a later
+// leader resumes instead of restoring again.
+func markBootstrapped(ctx context.Context, slotLSN string) {
+	db, err := sql.Open("postgres", pg2DSN)
+	if err != nil {
+		log.Printf("  [HA] bootstrap marker: %v", err)
+		return
+	}
+	defer db.Close()
+	host, _ := os.Hostname()
+	for _, q := range []string{
+		bootstrapDDL,
+		`INSERT INTO _cdc_bootstrap (slot_lsn, writer) VALUES ($1, $2)`,
+	} {
+		var args []interface{}
+		if q[0] == 'I' {
+			args = []interface{}{slotLSN, host}
+		}
+		if _, err := db.ExecContext(ctx, q, args...); err != nil {
+			log.Printf("  [HA] bootstrap marker: %v", err)
+			return
+		}
+	}
+}
+
+// resumeOffset returns the Kafka offset a topic's consumer starts from: the
+// one after the checkpoint read returns for it, or the first offset without
+// one.
+func resumeOffset(ctx context.Context, topic string, read checkpointReader) int64 {
+	pos, ok, err := read(ctx, topic)
+	if err != nil {
+		log.Printf("  [consumer] %s checkpoint: %v; reading from the first offset", topic, err)
+		return kafka.FirstOffset
+	}
+	if !ok {
+		return kafka.FirstOffset
+	}
+	log.Printf("  [consumer] %s resuming after checkpoint offset %d", topic, pos.Offset)
+	return pos.Offset + 1
+}
@@ -2,18 +2,49 @@
 // This file contains only the startup sequence and keep-alive loop.
 // All logic is delegated to purpose-specific files:
 //
-//   config.go      — Constants, table list, shared state
-//   waiters.go     — Service readiness checks (PG, Kafka, Debezium)
-//   replication.go — Slot creation, pg_dump, pg_restore
-//   connector.go   — Debezium connector deployment and status
-//   consumer.go    — Kafka consumer → postgres2 writer (upsert/delete)
-//   verify.go      — Test data insertion and verification
+//   config.go          — Constants, table list, shared state
+//   waiters.go         — Service readiness checks (PG, Kafka, Debezium)
+//   replication.go     — Slot creation, pg_dump, pg_restore
+//   connector.go       — Debezium connector deployment and status
+//   publication.go     — Source publication = configured tables, REPLICA IDENTITY checks
+//   consumer.go        — Kafka consumer → batches → sink
+//   pgoutput.go        — WRITER_SOURCE_MODE=pgoutput: slot streamed directly, no Kafka/Debezium
+//   throttle.go        — Global/per-table rate limits, adaptive backpressure
+//   workers.go         — Per-table key-partitioned worker pool, low-watermark checkpoints
+//   filter.go          — Per-table row filters and column projection
+//   mask.go            — Deterministic PII masking transforms per column
+//   mapping.go         — Target schema/table mapping, renames, injected columns
+//   sources.go         — Multi-source federation: site key namespacing, snapshot copy
+//   sink.go            — Sink interface, change-event model, sink registry
+//   sink_postgres.go   — postgres2 sink (upsert/delete, soft delete)
+//   fkgraph.go         — FK dependency graph: parents-first order, FK-violation retry
+//   keystate.go        — Per-key LSN guard and delete tombstones (_cdc_key_state)
+//   history.go         — SCD Type-2 <table>_history tables for the postgres2 sink
+//   sink_sqlite.go     — Embedded SQLite file sink
+//   sink_archive.go    — NDJSON/Parquet change-history archive sink
+//   sink_webhook.go    — HTTP webhook notification sink
+//   sink_kafka.go      — Kafka-to-Kafka republishing sink
+//   deadletter.go      — Dead-letter table for events a sink gave up on
+//   s3.go              — S3-compatible upload for archived files
+//   catalog.go         — Table schema lookup from the PG catalog
+//   shutdown.go        — Signal handling, in-flight drain, progress report
+//   leader.go          — HA leader election, bootstrap marker, checkpoint resume
+//   sequences.go       — Target SERIAL/identity sequences kept at or above the sources
+//   origin.go          — Origin tagging of applied transactions, echo filtering
+//   failback.go        — Reverse replication postgres2 → postgres1 (WRITER_FAILBACK)
+//   conflict.go        — Active-active conflict detection/resolution, _cdc_conflicts audit
+//   cutover.go         — `writer cutover`: freeze sources, drain, reconcile, go/no-go
+//   verify.go          — Test data insertion and verification
 package main
 
 import (
 	"context"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -21,6 +52,12 @@ import (
 
 func main() {
 	log.SetFlags(log.Ltime | log.Lmicroseconds)
+	if len(os.Args) > 1 && os.Args[1] == "cutover" {
+		if len(os.Args) > 2 && os.Args[2] == "abort" {
+			os.Exit(abortCutover())
+		}
+		os.Exit(runCutover())
+	}
 	log.Println("╔══════════════════════════════════════════════════════════╗")
 	log.Println("║  WRITER SERVICE                                         ║")
 	log.Println("║  1. Creates replication slot on postgres1               ║")
@@ -28,74 +65,177 @@ func main() {
 	log.Println("║  3. Deploys Debezium connector                          ║")
 	log.Println("║  4. Consumes Kafka CDC events → writes to postgres2     ║")
 	log.Println("╚══════════════════════════════════════════════════════════╝")
+	checkMaskSalt()
 
 	// ── Wait for all services ─────────────────────────
 	log.Println("\n[STEP 1] Waiting for postgres1 (source)...")
-	waitForPG("postgres1", pg1DSN, "devices")
-	logCounts("postgres1 BEFORE", pg1DSN)
+	for _, src := range sources {
+		waitForPG(src.Host, src.dsn(), "devices")
+		logCounts(src.Site+" BEFORE", src.dsn())
+	}
 
 	log.Println("[STEP 2] Waiting for postgres2 (target)...")
 	waitForHost("postgres2")
 
-	log.Println("[STEP 3] Waiting for Kafka...")
-	waitForKafka()
-
-	log.Println("[STEP 4] Waiting for Debezium...")
-	waitForDebezium()
-
-	// ── Create slot THEN dump ─────────────────────────
-	log.Println("\n[STEP 5] Creating replication slot on postgres1...")
-	log.Println("  This bookmarks the WAL. Everything from here is captured.")
-	slotLSN := createSlot()
+	if sourceMode == "kafka" {
+		log.Println("[STEP 3] Waiting for Kafka...")
+		waitForKafka()
 
-	log.Println("\n[STEP 6] pg_dump from postgres1...")
-	dumpFile, dumpDur := pgDump()
-
-	log.Println("\n[STEP 7] pg_restore into postgres2...")
-	restoreDur := pgRestore(dumpFile)
-	logCounts("postgres2 AFTER RESTORE", pg2DSN)
+		log.Println("[STEP 4] Waiting for Debezium...")
+		waitForDebezium()
+	}
 
-	// ── Deploy Debezium connector ─────────────────────
-	log.Println("\n[STEP 8] Deploying Debezium connector...")
-	log.Println("  snapshot.mode=never — Debezium reads WAL from slot, no re-snapshot")
-	deployConnector()
-	waitForConnector()
+	// ── Leadership (HA mode) ──────────────────────────
+	ctx := context.Background()
+	if haEnabled {
+		log.Println("\n[HA] Waiting for leadership (advisory lock on postgres2)...")
+		acquireLeadership(ctx)
+	}
+	resumed := haEnabled && bootstrapped(ctx)
+
+	// SIGINT/SIGTERM abort the bootstrap (checkAborted) or, once streaming,
+	// stop fetching; in-flight batches drain under applyCtx.
+	fetchCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var slotLSN string
+	var dumpDur, restoreDur time.Duration
+	var order []string
+	if resumed {
+		log.Println("\n[STEP 5-8] postgres2 already bootstrapped — taking over from checkpoints")
+		order = applyOrder(ctx, pg2DSN)
+		openSinks()
+		if sourceMode == "kafka" {
+			for _, src := range sources {
+				ensureConnector(src)
+				waitForConnector(src)
+			}
+		}
+	} else {
+		// ── Publication, then slot, THEN dump ─────────────
+		log.Println("\n[STEP 5] Syncing publications, creating replication slots on the sources...")
+		for _, src := range sources {
+			if err := ensurePublication(fetchCtx, src); err != nil {
+				log.Fatalf("  [publication] %s: %v", src.Site, err)
+			}
+		}
+		log.Println("  This bookmarks the WAL. Everything from here is captured.")
+		slotLSN = createSlot(sources[0])
+		for _, src := range sources[1:] {
+			createSlot(src)
+		}
+		checkAborted(fetchCtx)
+
+		log.Printf("\n[STEP 6] pg_dump from %s...", sources[0].Host)
+		var dumpFile string
+		dumpFile, dumpDur = pgDump(fetchCtx, sources[0])
+		checkAborted(fetchCtx, dumpFile)
+
+		log.Println("\n[STEP 7] pg_restore into postgres2...")
+		if failbackEnabled {
+			teardownFailback()
+		}
+		restoreDur = pgRestore(fetchCtx, dumpFile)
+		checkAborted(fetchCtx, dumpFile)
+		namespaceKeys(fetchCtx, pg2DSN, sources[0].Site)
+		applyFiltersToTarget(fetchCtx, pg2DSN, sources[0])
+		maskTarget(fetchCtx, pg2DSN)
+		seedMappedTables(fetchCtx, pg2DSN)
+		checkAborted(fetchCtx, dumpFile)
+		order = applyOrder(ctx, pg2DSN)
+		openSinks()
+		for _, src := range sources[1:] {
+			log.Printf("  Snapshot-copying %s (%s)...", src.Site, src.Host)
+			snapshotSource(fetchCtx, src, order)
+			checkAborted(fetchCtx, dumpFile)
+		}
+		logCounts("postgres2 AFTER RESTORE", pg2DSN)
+
+		// ── Deploy Debezium connector ─────────────────────
+		if sourceMode == "kafka" {
+			log.Println("\n[STEP 8] Deploying Debezium connectors...")
+			log.Println("  snapshot.mode=never — Debezium reads WAL from slot, no re-snapshot")
+			for _, src := range sources {
+				deployConnector(src)
+				waitForConnector(src)
+			}
+		}
+		checkAborted(fetchCtx, dumpFile)
+		markBootstrapped(ctx, slotLSN)
+	}
 
 	// ── Start Kafka consumers → write to postgres2 ────
-	log.Println("\n[STEP 9] Starting Kafka consumers → postgres2...")
-	ctx := context.Background()
-	for _, t := range tables {
-		go consumeAndWrite(ctx, "ome.public."+t, t)
+	applyCtx, cancelApply := context.WithCancel(ctx)
+	var consumers sync.WaitGroup
+	if sourceMode == "pgoutput" {
+		log.Println("\n[STEP 9] Streaming source slots (pgoutput) → sinks...")
+		for _, src := range sources {
+			consumers.Add(1)
+			go func() {
+				defer consumers.Done()
+				streamSource(fetchCtx, applyCtx, src)
+			}()
+		}
+	} else {
+		log.Println("\n[STEP 9] Starting Kafka consumers → sinks...")
+		// Parents first: a child's first batch then usually finds its parents.
+		for _, t := range order {
+			for _, src := range sources {
+				consumers.Add(1)
+				go func() {
+					defer consumers.Done()
+					consumeAndWrite(fetchCtx, applyCtx, src, t)
+				}()
+			}
+		}
+	}
+	go syncSequencesLoop(fetchCtx, syncSequences)
+	if failbackEnabled {
+		log.Println("\n[FAILBACK] Replicating postgres2 changes back to postgres1...")
+		startFailback(fetchCtx, applyCtx, &consumers)
 	}
-	log.Printf("  Started %d consumers", len(tables))
-	time.Sleep(8 * time.Second)
-
-	// ── Test: insert into postgres1, verify in postgres2
-	log.Println("\n[STEP 10] Inserting test data into postgres1 (post-dump)...")
-	insertTestData()
-
-	log.Println("[STEP 11] Waiting 15s for CDC...")
-	time.Sleep(15 * time.Second)
-	verify()
-
-	// ── Summary ───────────────────────────────────────
-	log.Println("\n══════════════════════════════════════════════════════════")
-	log.Println("  WRITER COMPLETE")
-	log.Println("══════════════════════════════════════════════════════════")
-	log.Printf("  Slot LSN:     %s", slotLSN)
-	log.Printf("  Dump:         %v", dumpDur)
-	log.Printf("  Restore:      %v", restoreDur)
-	log.Printf("  CDC applied:  %d events", atomic.LoadInt64(&written))
-	logCounts("postgres1 FINAL", pg1DSN)
-	logCounts("postgres2 FINAL", pg2DSN)
-	log.Println("\n  TRY LIVE:")
-	log.Println(`  podman exec postgres1 psql -U postgres -d omedb -c "INSERT INTO devices(service_tag,device_name,device_type_id,model,ip_address,health_status) VALUES('LIVETEST','live.local',1,'PowerEdge R750','10.99.99.1','OK');"`)
-	log.Println(`  podman exec postgres2 psql -U postgres -d omedb -c "SELECT id,service_tag,model,health_status FROM devices WHERE service_tag='LIVETEST';"`)
-	log.Println("══════════════════════════════════════════════════════════")
-
-	// Keep alive — consumers run in background goroutines
+	go func() {
+		<-fetchCtx.Done()
+		os.Exit(shutdown(&consumers, cancelApply))
+	}()
+	if sourceMode == "pgoutput" {
+		log.Printf("  Started %d slot streams", len(sources))
+	} else {
+		log.Printf("  Started %d consumers", len(sources)*len(tables))
+	}
+	if resumed {
+		log.Println("\n  WRITER RESUMED — streaming from stored checkpoints")
+	} else {
+		time.Sleep(8 * time.Second)
+
+		// ── Test: insert into postgres1, verify in postgres2
+		log.Println("\n[STEP 10] Inserting test data into postgres1 (post-dump)...")
+		insertTestData()
+
+		log.Println("[STEP 11] Waiting 15s for CDC...")
+		time.Sleep(15 * time.Second)
+		verify()
+
+		// ── Summary ───────────────────────────────────────
+		log.Println("\n══════════════════════════════════════════════════════════")
+		log.Println("  WRITER COMPLETE")
+		log.Println("══════════════════════════════════════════════════════════")
+		log.Printf("  Slot LSN:     %s", slotLSN)
+		log.Printf("  Dump:         %v", dumpDur)
+		log.Printf("  Restore:      %v", restoreDur)
+		log.Printf("  CDC applied:  %d events", atomic.LoadInt64(&written))
+		logCounts("postgres1 FINAL", pg1DSN)
+		logCounts("postgres2 FINAL", pg2DSN)
+		log.Println("\n  TRY LIVE:")
+		log.Println(`  podman exec postgres1 psql -U postgres -d omedb -c "INSERT INTO devices(service_tag,device_name,device_type_id,model,ip_address,health_status) VALUES('LIVETEST','live.local',1,'PowerEdge R750','10.99.99.1','OK');"`)
+		log.Println(`  podman exec postgres2 psql -U postgres -d omedb -c "SELECT id,service_tag,model,health_status FROM devices WHERE service_tag='LIVETEST';"`)
+		log.Println("══════════════════════════════════════════════════════════")
+	}
+
+	// Keep alive — consumers run in background goroutines until a signal
+	// triggers shutdown
 	for {
 		time.Sleep(10 * time.Second)
-		log.Printf("[writer] CDC events written: %d", atomic.LoadInt64(&written))
+		log.Printf("[writer] CDC events written: %d | throttle: %s", atomic.LoadInt64(&written), throttle.status())
 	}
 }
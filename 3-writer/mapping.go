@@ -0,0 +1,326 @@
+// mapping.go — Source-to-target table and column mapping.
+// Maps a source table to a target "schema.table", renames columns, and
+// injects constant or computed columns (e.g. source_site) so several OME
+// sources can land in one federation database. Mapping runs in the consumer
+// after filtering, so every sink sees target column names.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// computedColumn is a target column whose value is an SQL expression
+// evaluated by SQL sinks on every write, e.g. {Expr: "now()", Type: "timestamptz"}.
+type computedColumn struct {
+	Expr string
+	Type string
+}
+
+// targetOf returns the target schema and table name for a source table.
+func targetOf(table string) (schema, name string) {
+	t := configFor(table).Target
+	if t == "" {
+		return "public", table
+	}
+	if i := strings.IndexByte(t, '.'); i >= 0 {
+		return t[:i], t[i+1:]
+	}
+	return "public", t
+}
+
+// targetColumn returns the target name of a source column.
+func targetColumn(cfg tableConfig, col string) string {
+	if n, ok := cfg.Rename[col]; ok {
+		return n
+	}
+	return col
+}
+
+// mapEvent rewrites an event to target naming: sets Schema/Target/Key (the
+// source table's primary key, renamed), renames columns and injects
+// constants into both row images. With several sources the site id is
+// injected too and leads the key.
+func mapEvent(e changeEvent) changeEvent {
+	cfg := configFor(e.Table)
+	e.Schema, e.Target = targetOf(e.Table)
+	e.Key = nil
+	for _, k := range sourceKey(e.Table) {
+		e.Key = append(e.Key, targetColumn(cfg, k))
+	}
+	site := ""
+	if multiSource() {
+		site = e.Site
+		e.Key = append([]string{siteColumn}, e.Key...)
+	}
+	if len(cfg.Rename) == 0 && len(cfg.Constants) == 0 && site == "" {
+		return e
+	}
+	e.Before = mapRow(cfg, e.Before, site)
+	e.After = mapRow(cfg, e.After, site)
+	return e
+}
+
+// mapRow renames the columns of one row image and adds the constants and,
+// when set, the site column.
+func mapRow(cfg tableConfig, row map[string]interface{}, site string) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(row)+len(cfg.Constants)+1)
+	for k, v := range row {
+		out[targetColumn(cfg, k)] = v
+	}
+	for k, v := range cfg.Constants {
+		out[k] = v
+	}
+	if site != "" {
+		out[siteColumn] = site
+	}
+	return out
+}
+
+// qualifiedTarget returns the quoted schema.table of an event's target.
+func qualifiedTarget(e changeEvent) string {
+	return quoteIdent(e.Schema) + "." + quoteIdent(e.Target)
+}
+
+// isMapped reports whether a table's target differs from public.<table>
+// in name or shape.
+func isMapped(table string) bool {
+	cfg := configFor(table)
+	schema, name := targetOf(table)
+	return schema != "public" || name != table ||
+		len(cfg.Rename) > 0 || len(cfg.Constants) > 0 || len(cfg.Computed) > 0
+}
+
+// targetTableSchema derives the target table definition from the source
+// catalog: columns renamed, projected-away columns dropped, constant and
+// computed columns appended, key renamed. With several sources the site
+// column is added and leads the key.
+func targetTableSchema(ctx context.Context, catalog *sql.DB, table string) (tableSchema, error) {
+	src, err := loadTableSchema(ctx, catalog, "public", table)
+	if err != nil {
+		return src, err
+	}
+	return mapTableSchema(table, src), nil
+}
+
+// mapTableSchema applies a table's mapping to its source definition; see
+// targetTableSchema.
+func mapTableSchema(table string, src tableSchema) tableSchema {
+	cfg := configFor(table)
+	_, name := targetOf(table)
+	ts := tableSchema{Name: name}
+	for _, c := range src.Columns {
+		if !keepsColumn(table, c.Name) {
+			continue
+		}
+		ts.Columns = append(ts.Columns, column{Name: targetColumn(cfg, c.Name), Type: c.Type, NotNull: c.NotNull})
+	}
+	for _, k := range src.Key {
+		ts.Key = append(ts.Key, targetColumn(cfg, k))
+	}
+	for k, v := range cfg.Constants {
+		ts.Columns = append(ts.Columns, column{Name: k, Type: constantType(v)})
+	}
+	for k, c := range cfg.Computed {
+		ts.Columns = append(ts.Columns, column{Name: k, Type: c.Type})
+	}
+	if multiSource() && !contains(ts.Key, siteColumn) {
+		ts.Key = append([]string{siteColumn}, ts.Key...)
+		ts.Columns = append(ts.Columns, column{Name: siteColumn, Type: "text", NotNull: true})
+	}
+	return ts
+}
+
+// constantType picks a PostgreSQL type for a constant column value.
+func constantType(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case int, int32, int64:
+		return "bigint"
+	case float32, float64:
+		return "numeric"
+	default:
+		return "text"
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════
+// BOOTSTRAP: MOVE RESTORED ROWS INTO MAPPED TARGETS
+// ═══════════════════════════════════════════════════════════════
+
+// seedMappedTables creates the target table of every mapped source table on
+// postgres2 and moves the rows pg_restore put into public.<table> there,
+// applying renames, constants and computed columns. The restored public copy
+// is dropped afterwards so no stale, unreplicated copy is left behind; see
+// dropRestoredCopy.
+func seedMappedTables(ctx context.Context, dsn string) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Printf("  [mapping] %v", err)
+		return
+	}
+	defer db.Close()
+
+	for _, t := range tables {
+		if !isMapped(t) {
+			continue
+		}
+		cfg := configFor(t)
+		schema, name := targetOf(t)
+		ts, err := targetTableSchema(ctx, db, t)
+		if err != nil {
+			log.Printf("  [mapping] %s: %v", t, err)
+			continue
+		}
+		if schema == "public" && name == t {
+			seedInPlace(ctx, db, t, ts)
+			continue
+		}
+		if err := createPostgresTable(ctx, db, schema, ts); err != nil {
+			log.Printf("  [mapping] %s: %v", t, err)
+			continue
+		}
+
+		src, _ := loadTableSchema(ctx, db, "public", t)
+		var cols, sel []string
+		var args []interface{}
+		for _, c := range src.Columns {
+			if keepsColumn(t, c.Name) {
+				cols = append(cols, quoteIdent(targetColumn(cfg, c.Name)))
+				sel = append(sel, quoteIdent(c.Name))
+			}
+		}
+		for k, v := range cfg.Constants {
+			args = append(args, v)
+			cols = append(cols, quoteIdent(k))
+			sel = append(sel, fmt.Sprintf("$%d", len(args)))
+		}
+		for k, c := range cfg.Computed {
+			cols = append(cols, quoteIdent(k))
+			sel = append(sel, c.Expr)
+		}
+		q := fmt.Sprintf("INSERT INTO %s.%s (%s) SELECT %s FROM public.%s ON CONFLICT DO NOTHING",
+			quoteIdent(schema), quoteIdent(name), strings.Join(cols, ","), strings.Join(sel, ","), quoteIdent(t))
+		res, err := db.ExecContext(ctx, q, args...)
+		if err != nil {
+			log.Printf("  [mapping] seed %s.%s: %v", schema, name, err)
+			continue
+		}
+		n, _ := res.RowsAffected()
+		log.Printf("  [mapping] public.%s → %s.%s (%d rows)", t, schema, name, n)
+		dropRestoredCopy(ctx, db, t)
+	}
+}
+
+// dropRestoredCopy drops public.<table> once its rows were moved to the
+// mapped target, but only when the writer created it: a full restore
+// recreates the database, so every public table came from the dump. With
+// WRITER_RESTORE_MODE=data-only the table existed before and is left alone.
+// Foreign keys of other tables pointing at it are dropped by name; anything
+// else depending on it (views, ...) makes the drop fail rather than cascade.
+func dropRestoredCopy(ctx context.Context, db *sql.DB, table string) {
+	if restoreDataOnly {
+		log.Printf("  [mapping] public.%s predates the restore, left in place (not replicated)", table)
+		return
+	}
+	rows, err := db.QueryContext(ctx, `SELECT conrelid::regclass::text, conname FROM pg_constraint
+		WHERE contype = 'f' AND confrelid = to_regclass($1) AND conrelid <> confrelid`, "public."+quoteIdent(table))
+	if err != nil {
+		log.Printf("  [mapping] drop public.%s: %v", table, err)
+		return
+	}
+	var fks [][2]string
+	for rows.Next() {
+		var rel, name string
+		if err := rows.Scan(&rel, &name); err != nil {
+			rows.Close()
+			log.Printf("  [mapping] drop public.%s: %v", table, err)
+			return
+		}
+		fks = append(fks, [2]string{rel, name})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("  [mapping] drop public.%s: %v", table, err)
+		return
+	}
+	for _, fk := range fks {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", fk[0], quoteIdent(fk[1]))); err != nil {
+			log.Printf("  [mapping] drop public.%s: %v", table, err)
+			return
+		}
+		log.Printf("  [mapping] dropped foreign key %s on %s (referenced public.%s)", fk[1], fk[0], table)
+	}
+	if _, err := db.ExecContext(ctx, "DROP TABLE public."+quoteIdent(table)); err != nil {
+		log.Printf("  [mapping] drop public.%s: %v", table, err)
+	}
+}
+
+// seedInPlace reshapes a restored table that keeps its public name: renames
+// columns, adds constant/computed columns and fills them for existing rows.
+func seedInPlace(ctx context.Context, db *sql.DB, table string, ts tableSchema) {
+	cfg := configFor(table)
+	rel := "public." + quoteIdent(table)
+	for from, to := range cfg.Rename {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s",
+			rel, quoteIdent(from), quoteIdent(to))); err != nil {
+			log.Printf("  [mapping] %s rename %s: %v", table, from, err)
+		}
+	}
+	if err := createPostgresTable(ctx, db, "public", ts); err != nil {
+		log.Printf("  [mapping] %s: %v", table, err)
+		return
+	}
+	var sets []string
+	var args []interface{}
+	for k, v := range cfg.Constants {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s=$%d", quoteIdent(k), len(args)))
+	}
+	for k, c := range cfg.Computed {
+		sets = append(sets, fmt.Sprintf("%s=%s", quoteIdent(k), c.Expr))
+	}
+	if len(sets) > 0 {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s", rel, strings.Join(sets, ",")), args...); err != nil {
+			log.Printf("  [mapping] %s fill: %v", table, err)
+		}
+	}
+	log.Printf("  [mapping] public.%s reshaped in place", table)
+}
+
+// createPostgresTable creates schema.table from a tableSchema if missing,
+// and adds any columns an existing table lacks.
+func createPostgresTable(ctx context.Context, db *sql.DB, schema string, ts tableSchema) error {
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS "+quoteIdent(schema)); err != nil {
+		return err
+	}
+	var defs []string
+	for _, c := range ts.Columns {
+		d := quoteIdent(c.Name) + " " + c.Type
+		if c.NotNull {
+			d += " NOT NULL"
+		}
+		defs = append(defs, d)
+	}
+	if len(ts.Key) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+quoteIdents(ts.Key)+")")
+	}
+	rel := quoteIdent(schema) + "." + quoteIdent(ts.Name)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", rel, strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	for _, c := range ts.Columns {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+			rel, quoteIdent(c.Name), c.Type)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// mapping_test.go — Tests for target naming, row mapping and target table definitions.
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// withSourceKey caches key as the catalog primary key of table for a test.
+func withSourceKey(t *testing.T, table string, key []string) {
+	t.Helper()
+	sourceKeysMu.Lock()
+	sourceKeys[table] = key
+	sourceKeysMu.Unlock()
+	t.Cleanup(func() {
+		sourceKeysMu.Lock()
+		delete(sourceKeys, table)
+		sourceKeysMu.Unlock()
+	})
+}
+
+// withSources replaces the configured sources for a test.
+func withSources(t *testing.T, srcs []source) {
+	t.Helper()
+	old := sources
+	sources = srcs
+	t.Cleanup(func() { sources = old })
+}
+
+func TestTargetOf(t *testing.T) {
+	withTableConfig(t, "map_plain", tableConfig{})
+	withTableConfig(t, "map_renamed", tableConfig{Target: "hosts"})
+	withTableConfig(t, "map_moved", tableConfig{Target: "inventory.hosts"})
+
+	tests := []struct {
+		table, schema, name string
+		mapped              bool
+	}{
+		{"map_plain", "public", "map_plain", false},
+		{"map_renamed", "public", "hosts", true},
+		{"map_moved", "inventory", "hosts", true},
+	}
+	for _, tt := range tests {
+		schema, name := targetOf(tt.table)
+		if schema != tt.schema || name != tt.name {
+			t.Errorf("targetOf(%s) = %s.%s, want %s.%s", tt.table, schema, name, tt.schema, tt.name)
+		}
+		if got := isMapped(tt.table); got != tt.mapped {
+			t.Errorf("isMapped(%s) = %v, want %v", tt.table, got, tt.mapped)
+		}
+	}
+}
+
+func TestMapEvent(t *testing.T) {
+	single := []source{{Site: "site1"}}
+	several := []source{{Site: "site1"}, {Site: "site2"}}
+	withSourceKey(t, "map_t", []string{"id"})
+	withSourceKey(t, "map_c", []string{"tenant", "id"})
+	withTableConfig(t, "map_t", tableConfig{Target: "inventory.hosts",
+		Rename:    map[string]string{"id": "device_id", "name": "hostname"},
+		Constants: map[string]interface{}{"origin": "ome"}})
+	withTableConfig(t, "map_c", tableConfig{})
+
+	row := map[string]interface{}{"id": float64(7), "name": "r750", "model": "R750"}
+	tests := []struct {
+		name       string
+		sources    []source
+		e          changeEvent
+		wantTarget string
+		wantKey    []string
+		wantAfter  map[string]interface{}
+		wantBefore map[string]interface{}
+	}{
+		{"rename and constants", single, changeEvent{Table: "map_t", Site: "site1", Op: "c", After: row},
+			"inventory.hosts", []string{"device_id"},
+			map[string]interface{}{"device_id": float64(7), "hostname": "r750", "model": "R750", "origin": "ome"}, nil},
+		{"delete maps the before image", single, changeEvent{Table: "map_t", Site: "site1", Op: "d", Before: map[string]interface{}{"id": float64(7)}},
+			"inventory.hosts", []string{"device_id"},
+			nil, map[string]interface{}{"device_id": float64(7), "origin": "ome"}},
+		{"site leads the renamed key", several, changeEvent{Table: "map_t", Site: "site2", Op: "u", After: row},
+			"inventory.hosts", []string{siteColumn, "device_id"},
+			map[string]interface{}{"device_id": float64(7), "hostname": "r750", "model": "R750", "origin": "ome", siteColumn: "site2"}, nil},
+		{"unmapped table keeps its images", single, changeEvent{Table: "map_c", Site: "site1", Op: "c", After: row},
+			"public.map_c", []string{"tenant", "id"}, row, nil},
+		{"composite key with site", several, changeEvent{Table: "map_c", Site: "site2", Op: "c", After: row},
+			"public.map_c", []string{siteColumn, "tenant", "id"},
+			map[string]interface{}{"id": float64(7), "name": "r750", "model": "R750", siteColumn: "site2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSources(t, tt.sources)
+			got := mapEvent(tt.e)
+			if target := got.Schema + "." + got.Target; target != tt.wantTarget {
+				t.Errorf("target = %s, want %s", target, tt.wantTarget)
+			}
+			if !reflect.DeepEqual(got.Key, tt.wantKey) {
+				t.Errorf("key = %v, want %v", got.Key, tt.wantKey)
+			}
+			if !reflect.DeepEqual(got.After, tt.wantAfter) || !reflect.DeepEqual(got.Before, tt.wantBefore) {
+				t.Errorf("images = %v / %v, want %v / %v", got.Before, got.After, tt.wantBefore, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestMapTableSchema(t *testing.T) {
+	withTableConfig(t, "map_s", tableConfig{Target: "inventory.hosts",
+		Rename:    map[string]string{"id": "device_id"},
+		Exclude:   []string{"notes"},
+		Constants: map[string]interface{}{"origin": "ome"},
+		Computed:  map[string]computedColumn{"synced_at": {Expr: "now()", Type: "timestamptz"}}})
+	withSourceKey(t, "map_s", []string{"id"})
+	src := tableSchema{Name: "map_s", Key: []string{"id"}, Columns: []column{
+		{Name: "id", Type: "integer", NotNull: true},
+		{Name: "name", Type: "character varying(20)"},
+		{Name: "notes", Type: "text"},
+	}}
+	mapped := []column{
+		{Name: "device_id", Type: "integer", NotNull: true},
+		{Name: "name", Type: "character varying(20)"},
+		{Name: "origin", Type: "text"},
+		{Name: "synced_at", Type: "timestamptz"},
+	}
+
+	tests := []struct {
+		name    string
+		sources []source
+		want    tableSchema
+	}{
+		{"single source", []source{{Site: "site1"}},
+			tableSchema{Name: "hosts", Key: []string{"device_id"}, Columns: mapped}},
+		{"several sources", []source{{Site: "site1"}, {Site: "site2"}},
+			tableSchema{Name: "hosts", Key: []string{siteColumn, "device_id"},
+				Columns: append(append([]column{}, mapped...), column{Name: siteColumn, Type: "text", NotNull: true})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withSources(t, tt.sources)
+			if got := mapTableSchema("map_s", src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapTableSchema =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstantType(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{true, "boolean"},
+		{7, "bigint"},
+		{int64(7), "bigint"},
+		{1.5, "numeric"},
+		{"ome", "text"},
+		{nil, "text"},
+	}
+	for _, tt := range tests {
+		if got := constantType(tt.v); got != tt.want {
+			t.Errorf("constantType(%#v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// mask.go — Column-level PII masking in the apply path.
+// Transforms come from tableConfig.Mask and run in the consumer after
+// filtering and before mapping, so every sink only ever sees masked values.
+// All transforms are deterministic (keyed by maskSalt, not random): the same
+// input always yields the same output, so joins and GROUP BYs on masked
+// columns in postgres2 still line up across tables and sources.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// columnTransform describes how one column is masked.
+//
+// Kinds:
+//
+//	hash       hex HMAC-SHA256 of the value (64 chars)
+//	tokenize   Prefix + 16-char base32 token derived from the HMAC
+//	redact     replaced by With (default "REDACTED")
+//	truncate   first Keep characters
+//	ip_mask    network address of the IP's /Bits subnet (default 24, 64 for IPv6)
+//	format     format-preserving replacement: letters stay letters of the same
+//	           case, digits stay digits, everything else (@ . - space) is kept
+//
+// Values are masked in their PostgreSQL text form (see maskText), the form
+// maskTarget reads restored rows in, so a row masks the same way whether it
+// arrived in the dump or in the stream. NULLs stay NULL. Transforms that can
+// map distinct inputs to one output (redact, truncate, ip_mask) must not be
+// used on columns with a UNIQUE constraint on the target.
+type columnTransform struct {
+	Kind   string
+	Prefix string // tokenize
+	With   string // redact
+	Keep   int    // truncate
+	Bits   int    // ip_mask
+}
+
+// maskEvent applies the table's column transforms to both row images.
+func maskEvent(e changeEvent) changeEvent {
+	cfg := configFor(e.Table)
+	if len(cfg.Mask) == 0 {
+		return e
+	}
+	e.Before = maskRow(cfg, e.Before)
+	e.After = maskRow(cfg, e.After)
+	return e
+}
+
+// maskRow returns a copy of row with masked columns transformed.
+func maskRow(cfg tableConfig, row map[string]interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		if t, ok := cfg.Mask[k]; ok && v != nil {
+			v = t.apply(maskText(v))
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// maskText renders a decoded JSON value like PostgreSQL's ::text output:
+// numbers without exponent or trailing zeros (1000000, not 1e+06).
+func maskText(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// checkMaskSalt refuses to start when a table masks columns and
+// CDC_MASK_SALT is empty: unsalted digests of emails or names can be
+// reversed by guessing.
+func checkMaskSalt() {
+	if maskSalt != "" {
+		return
+	}
+	for _, t := range tables {
+		if len(configFor(t).Mask) > 0 {
+			log.Fatalf("  [mask] %s masks columns but CDC_MASK_SALT is not set", t)
+		}
+	}
+}
+
+// apply masks one non-NULL value.
+func (t columnTransform) apply(s string) string {
+	switch t.Kind {
+	case "hash":
+		return hex.EncodeToString(maskMAC(s))
+	case "tokenize":
+		return t.Prefix + strings.ToLower(base32.StdEncoding.EncodeToString(maskMAC(s)[:10]))
+	case "redact":
+		if t.With == "" {
+			return "REDACTED"
+		}
+		return t.With
+	case "truncate":
+		if utf8.RuneCountInString(s) <= t.Keep {
+			return s
+		}
+		return string([]rune(s)[:t.Keep])
+	case "ip_mask":
+		return maskIP(s, t.Bits)
+	case "format":
+		return formatPreserving(s)
+	}
+	log.Printf("  [mask] unknown transform %q, redacting", t.Kind)
+	return "REDACTED"
+}
+
+// maskMAC is the keyed digest all deterministic transforms derive from.
+func maskMAC(s string) []byte {
+	return hmacSHA256([]byte(maskSalt), s)
+}
+
+// maskIP zeroes the host bits of an IP address (an inet value may carry a
+// /prefix, which is dropped). Unparseable values are redacted.
+func maskIP(s string, bits int) string {
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "0.0.0.0"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		if bits <= 0 || bits > 32 {
+			bits = 24
+		}
+		return v4.Mask(net.CIDRMask(bits, 32)).String()
+	}
+	if bits <= 0 || bits > 128 {
+		bits = 64
+	}
+	return ip.Mask(net.CIDRMask(bits, 128)).String()
+}
+
+// formatPreserving replaces every letter and digit using a keystream derived
+// from the value's HMAC, keeping length, case and punctuation, so masked
+// emails still look like emails and still fit the column.
+func formatPreserving(s string) string {
+	seed := maskMAC(s)
+	var b strings.Builder
+	i := 0
+	for _, r := range s {
+		n := binary.BigEndian.Uint32(hmacSHA256(seed, fmt.Sprint(i)))
+		switch {
+		case unicode.IsDigit(r):
+			b.WriteByte(byte('0' + n%10))
+		case unicode.IsUpper(r):
+			b.WriteByte(byte('A' + n%26))
+		case unicode.IsLetter(r):
+			b.WriteByte(byte('a' + n%26))
+		default:
+			b.WriteRune(r)
+		}
+		i++
+	}
+	return b.String()
+}
+
+// ═══════════════════════════════════════════════════════════════
+// BOOTSTRAP: MASK RESTORED ROWS
+// ═══════════════════════════════════════════════════════════════
+
+// maskTarget rewrites masked columns of the rows pg_restore put into
+// postgres2, using the same Go transforms as the stream so restored and
+// replicated values agree. Call after applyFiltersToTarget (filters see raw
+// values) and before seedMappedTables.
+func maskTarget(ctx context.Context, dsn string) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Printf("  [mask] %v", err)
+		return
+	}
+	defer db.Close()
+
+	for _, t := range tables {
+		cfg := configFor(t)
+		if len(cfg.Mask) == 0 {
+			continue
+		}
+		n, err := maskTable(ctx, db, t, cfg)
+		if err != nil {
+			log.Fatalf("  [mask] %s: %v", t, err)
+		}
+		log.Printf("  [mask] %s: masked %d restored rows", t, n)
+	}
+}
+
+// maskTable masks one restored table row by row (addressed by ctid) in a
+// single transaction.
+func maskTable(ctx context.Context, db *sql.DB, table string, cfg tableConfig) (int, error) {
+	var cols []string
+	for c := range cfg.Mask {
+		cols = append(cols, c)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT ctid::text, %s FROM public.%s",
+		castText(cols), quoteIdent(table)))
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		ctid string
+		vals []interface{}
+	}
+	var updates []pending
+	for rows.Next() {
+		raw := make([]sql.NullString, len(cols))
+		dest := []interface{}{new(string)}
+		for i := range raw {
+			dest = append(dest, &raw[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		p := pending{ctid: *dest[0].(*string)}
+		for i, c := range cols {
+			if raw[i].Valid {
+				p.vals = append(p.vals, cfg.Mask[c].apply(raw[i].String))
+			} else {
+				p.vals = append(p.vals, nil)
+			}
+		}
+		updates = append(updates, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var sets []string
+	for i, c := range cols {
+		sets = append(sets, fmt.Sprintf("%s=$%d", quoteIdent(c), i+1))
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE public.%s SET %s WHERE ctid=$%d::tid",
+		quoteIdent(table), strings.Join(sets, ","), len(cols)+1))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, p := range updates {
+		if _, err := stmt.ExecContext(ctx, append(p.vals, p.ctid)...); err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), tx.Commit()
+}
+
+// castText renders a select list reading each column as text.
+func castText(cols []string) string {
+	parts := make([]string, len(cols))
+	for i, c := range cols {
+		parts[i] = quoteIdent(c) + "::text"
+	}
+	return strings.Join(parts, ", ")
+}
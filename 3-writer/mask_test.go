@@ -0,0 +1,87 @@
+// mask_test.go — Tests for the masking transforms and their input text form.
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMaskTransforms(t *testing.T) {
+	saved := maskSalt
+	maskSalt = "test-salt"
+	defer func() { maskSalt = saved }()
+
+	tests := []struct {
+		name  string
+		tr    columnTransform
+		in    string
+		want  string // exact output, when known
+		shape string // regexp the output must match, otherwise
+	}{
+		{"hash", columnTransform{Kind: "hash"}, "alice@example.com", "", `^[0-9a-f]{64}$`},
+		{"tokenize", columnTransform{Kind: "tokenize", Prefix: "user_"}, "Alice Smith", "", `^user_[a-z2-7]{16}$`},
+		{"redact default", columnTransform{Kind: "redact"}, "secret", "REDACTED", ""},
+		{"redact with", columnTransform{Kind: "redact", With: "***"}, "secret", "***", ""},
+		{"truncate", columnTransform{Kind: "truncate", Keep: 3}, "Zürich", "Zür", ""},
+		{"truncate short", columnTransform{Kind: "truncate", Keep: 10}, "Bern", "Bern", ""},
+		{"ip_mask v4 default", columnTransform{Kind: "ip_mask"}, "10.1.2.3", "10.1.2.0", ""},
+		{"ip_mask v4 /16 inet", columnTransform{Kind: "ip_mask", Bits: 16}, "10.1.2.3/32", "10.1.0.0", ""},
+		{"ip_mask v6", columnTransform{Kind: "ip_mask"}, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::", ""},
+		{"ip_mask invalid", columnTransform{Kind: "ip_mask"}, "not-an-ip", "0.0.0.0", ""},
+		{"format email", columnTransform{Kind: "format"}, "Bob.Jones-42@mail.com", "", `^[A-Z][a-z]{2}\.[A-Z][a-z]{4}-[0-9]{2}@[a-z]{4}\.[a-z]{3}$`},
+		{"unknown kind", columnTransform{Kind: "rot13"}, "x", "REDACTED", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.tr.apply(tt.in)
+			if again := tt.tr.apply(tt.in); again != got {
+				t.Fatalf("not deterministic: %q then %q", got, again)
+			}
+			if tt.shape != "" {
+				if !regexp.MustCompile(tt.shape).MatchString(got) {
+					t.Errorf("apply(%q) = %q, want match %s", tt.in, got, tt.shape)
+				}
+				if got == tt.in {
+					t.Errorf("apply(%q) left the value unmasked", tt.in)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("apply(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskSaltKeysDigests(t *testing.T) {
+	saved := maskSalt
+	defer func() { maskSalt = saved }()
+	tr := columnTransform{Kind: "hash"}
+	maskSalt = "a"
+	first := tr.apply("value")
+	maskSalt = "b"
+	if tr.apply("value") == first {
+		t.Error("digest does not depend on the salt")
+	}
+}
+
+func TestMaskText(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string // PostgreSQL ::text output of the same value
+	}{
+		{float64(1000000), "1000000"},
+		{float64(42), "42"},
+		{float64(-7), "-7"},
+		{float64(0.25), "0.25"},
+		{float64(123456789012), "123456789012"},
+		{true, "true"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"1234.50", "1234.50"},
+	}
+	for _, tt := range tests {
+		if got := maskText(tt.in); got != tt.want {
+			t.Errorf("maskText(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
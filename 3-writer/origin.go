@@ -0,0 +1,206 @@
+// origin.go — Origin tagging to keep replicated changes from echoing back.
+// When changes flow in both directions (failback, see failback.go) every
+// change the writer applies is captured again by the other side's slot. Each
+// apply transaction therefore records its own transaction id in
+// _cdc_origin_tx of the database it writes to. Debezium reports the
+// transaction id of every change (source.txId), so a consumer drops events
+// whose transaction is listed in _cdc_origin_tx of the database they were
+// captured from: those are the writer's own writes coming back.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// originDDL creates the table of transaction ids written by the writer.
+// xid is the 32-bit transaction id Debezium reports as source.txId; lsn is
+// the WAL position when the transaction was tagged, before its changes.
+const originDDL = `CREATE TABLE IF NOT EXISTS _cdc_origin_tx (
+	xid BIGINT PRIMARY KEY, lsn BIGINT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW())`
+
+// tagOrigin records the transaction as one of the writer's own. Call it in
+// every apply transaction of a database whose changes are replicated back.
+func tagOrigin(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO _cdc_origin_tx (xid, lsn)
+		VALUES (txid_current() % 4294967296, (pg_current_wal_lsn() - '0/0'::pg_lsn)::bigint)
+		ON CONFLICT (xid) DO UPDATE SET lsn = EXCLUDED.lsn, applied_at = NOW()`)
+	return err
+}
+
+var (
+	originDBs   = make(map[string]*sql.DB)
+	originDBsMu sync.Mutex
+)
+
+// originDB returns the shared connection pool used for echo lookups in the
+// database at dsn.
+func originDB(dsn string) (*sql.DB, error) {
+	originDBsMu.Lock()
+	defer originDBsMu.Unlock()
+	if db, ok := originDBs[dsn]; ok {
+		return db, nil
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	originDBs[dsn] = db
+	return db, nil
+}
+
+// closeOriginDBs closes the echo lookup pools.
+func closeOriginDBs() {
+	originDBsMu.Lock()
+	defer originDBsMu.Unlock()
+	for dsn, db := range originDBs {
+		db.Close()
+		delete(originDBs, dsn)
+	}
+}
+
+// dropEchoes removes the events of a batch that the writer itself applied
+// to the database at dsn, where the batch was captured. A missing
+// _cdc_origin_tx means nothing was written there and keeps the batch; any
+// other lookup error is returned, since applying an echo again would tag it
+// again on the other side and send it back.
+func dropEchoes(ctx context.Context, dsn string, batch []changeEvent) ([]changeEvent, error) {
+	if len(batch) == 0 {
+		return batch, nil
+	}
+	db, err := originDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT xid FROM _cdc_origin_tx WHERE xid = ANY($1)", pq.Array(batchXIDs(batch)))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+		return batch, nil // not created yet: nothing was written there
+	}
+	if err != nil {
+		return nil, fmt.Errorf("echo lookup: %w", err)
+	}
+	defer rows.Close()
+	echo := make(map[int64]bool)
+	for rows.Next() {
+		var x int64
+		if err := rows.Scan(&x); err != nil {
+			return nil, fmt.Errorf("echo lookup: %w", err)
+		}
+		echo[x] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("echo lookup: %w", err)
+	}
+	return withoutEchoes(batch, echo), nil
+}
+
+// batchXIDs lists the distinct transaction ids of a batch.
+func batchXIDs(batch []changeEvent) []int64 {
+	var xids []int64
+	seen := make(map[int64]bool)
+	for _, e := range batch {
+		if !seen[e.TxID] {
+			seen[e.TxID] = true
+			xids = append(xids, e.TxID)
+		}
+	}
+	return xids
+}
+
+// withoutEchoes drops the events of the echoed transactions, in place.
+func withoutEchoes(batch []changeEvent, echo map[int64]bool) []changeEvent {
+	if len(echo) == 0 {
+		return batch
+	}
+	kept := batch[:0]
+	for _, e := range batch {
+		if !echo[e.TxID] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// originReaders maps each topic capturing a database's changes to the
+// checkpoint reader of the consumer applying it.
+type originReaders map[string]checkpointReader
+
+// pruneOriginsLoop prunes the tagged transactions of the databases at the
+// given DSNs every hour until ctx is cancelled (see pruneOrigins).
+func pruneOriginsLoop(ctx context.Context, dbs map[string]originReaders) {
+	for {
+		for dsn, readers := range dbs {
+			if err := pruneOrigins(ctx, dsn, readers); err != nil && ctx.Err() == nil {
+				log.Printf("  [origin] prune: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// pruneOrigins deletes the tagged transactions of the database at dsn that
+// every consumer of its changes has checkpointed past, once they are older
+// than originRetention. A topic that holds events but has no checkpoint yet
+// keeps every tag; empty topics are ignored.
+func pruneOrigins(ctx context.Context, dsn string, readers originReaders) error {
+	floor, err := originFloor(ctx, readers, lastOffset)
+	if err != nil || floor < 0 {
+		return err
+	}
+	db, err := originDB(dsn)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM _cdc_origin_tx
+		WHERE lsn < $1 AND applied_at < NOW() - make_interval(secs => $2)`, floor, originRetention.Seconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("  [origin] pruned %d transactions", n)
+	}
+	return nil
+}
+
+// originFloor returns the lowest checkpointed LSN of the readers' topics, or
+// -1 when nothing can be pruned: no topic is checkpointed, or one holds
+// events (last offset ≥ 0) without a checkpoint.
+func originFloor(ctx context.Context, readers originReaders, last func(context.Context, string) (int64, error)) (int64, error) {
+	floor := int64(-1)
+	for topic, read := range readers {
+		pos, ok, err := read(ctx, topic)
+		if errors.Is(err, errNoCheckpoints) {
+			continue // replayed from the start anyway
+		}
+		if err != nil {
+			return -1, fmt.Errorf("%s: %w", topic, err)
+		}
+		if !ok {
+			n, err := last(ctx, topic)
+			if err != nil {
+				return -1, fmt.Errorf("%s: %w", topic, err)
+			}
+			if n >= 0 {
+				return -1, nil
+			}
+			continue
+		}
+		if floor < 0 || pos.LSN < floor {
+			floor = pos.LSN
+		}
+	}
+	return floor, nil
+}
@@ -0,0 +1,101 @@
+// origin_test.go — Tests for echo detection and the origin tag pruning floor.
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWithoutEchoes(t *testing.T) {
+	batch := func() []changeEvent {
+		return []changeEvent{{TxID: 10, Offset: 1}, {TxID: 11, Offset: 2}, {TxID: 10, Offset: 3}, {TxID: 12, Offset: 4}}
+	}
+	tests := []struct {
+		name string
+		echo map[int64]bool
+		want []int64 // offsets kept
+	}{
+		{"no echoes", nil, []int64{1, 2, 3, 4}},
+		{"one transaction echoed", map[int64]bool{10: true}, []int64{2, 4}},
+		{"all echoed", map[int64]bool{10: true, 11: true, 12: true}, nil},
+		{"unrelated transaction", map[int64]bool{99: true}, []int64{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for _, e := range withoutEchoes(batch(), tt.echo) {
+			got = append(got, e.Offset)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := batchXIDs(batch()); !reflect.DeepEqual(got, []int64{10, 11, 12}) {
+		t.Errorf("batchXIDs = %v, want [10 11 12]", got)
+	}
+}
+
+func TestDropEchoesLookupErrors(t *testing.T) {
+	const unreachable = "postgres://writer@127.0.0.1:1/omedb?sslmode=disable&connect_timeout=1"
+	tests := []struct {
+		name    string
+		batch   []changeEvent
+		wantLen int
+		wantErr bool
+	}{
+		{"empty batch needs no lookup", nil, 0, false},
+		{"unreachable database", []changeEvent{{TxID: 10}}, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := dropEchoes(context.Background(), unreachable, tt.batch)
+		if (err != nil) != tt.wantErr || len(got) != tt.wantLen {
+			t.Errorf("%s: dropEchoes = %d events, %v; want %d, error %v", tt.name, len(got), err, tt.wantLen, tt.wantErr)
+		}
+	}
+}
+
+func TestOriginFloor(t *testing.T) {
+	checkpoint := func(lsn int64) checkpointReader {
+		return func(ctx context.Context, topic string) (position, bool, error) {
+			return position{Topic: topic, LSN: lsn}, true, nil
+		}
+	}
+	none := func(ctx context.Context, topic string) (position, bool, error) {
+		return position{Topic: topic}, false, nil
+	}
+	noSinks := func(ctx context.Context, topic string) (position, bool, error) {
+		return position{}, false, errNoCheckpoints
+	}
+	failing := func(ctx context.Context, topic string) (position, bool, error) {
+		return position{}, false, errors.New("connection refused")
+	}
+	// Topics named "empty" hold no events.
+	last := func(ctx context.Context, topic string) (int64, error) {
+		if topic == "empty" {
+			return -1, nil
+		}
+		return 41, nil
+	}
+
+	tests := []struct {
+		name    string
+		readers originReaders
+		want    int64
+		wantErr bool
+	}{
+		{"one topic", originReaders{"a": checkpoint(900)}, 900, false},
+		{"lowest checkpoint", originReaders{"a": checkpoint(900), "b": checkpoint(400)}, 400, false},
+		{"empty topic without checkpoint ignored", originReaders{"a": checkpoint(900), "empty": none}, 900, false},
+		{"topic with events but no checkpoint blocks", originReaders{"a": checkpoint(900), "b": none}, -1, false},
+		{"sinks without checkpoints ignored", originReaders{"a": checkpoint(900), "b": noSinks}, 900, false},
+		{"nothing checkpointed", originReaders{"empty": none}, -1, false},
+		{"reader error", originReaders{"a": checkpoint(900), "b": failing}, -1, true},
+	}
+	for _, tt := range tests {
+		got, err := originFloor(context.Background(), tt.readers, last)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: floor = %d, %v; want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// pgoutput.go — Native source mode: streaming a slot without Kafka/Debezium.
+// With WRITER_SOURCE_MODE=pgoutput every source's slot is read directly over
+// the streaming replication protocol with the pgoutput plugin and the
+// source's publication. Relation/Insert/Update/Delete/Truncate messages are
+// decoded into the same changeEvent model Debezium produces, so filters,
+// masking, mapping and sinks work unchanged.
+//
+// Whole transactions are batched at commit boundaries and applied in source
+// order, one run of consecutive same-table events at a time; the relations
+// of one TRUNCATE are applied together, children first. An event's Offset
+// is its transaction's commit LSN, which stays the same when the slot is
+// replayed after a reconnect, and the topic is the slot. Only once every
+// sink committed and checkpointed a batch (and made it durable, see
+// laggingSink) is its end LSN reported as flushed in a standby status
+// update, so the slot never moves past unapplied changes: after a crash or
+// reconnect the source replays from the last flushed commit and the
+// idempotent sinks absorb the overlap.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// pgoutputStream is the decoding state of one source's replication stream.
+type pgoutputStream struct {
+	src       source
+	relations map[uint32]*pglogrepl.RelationMessage
+	tracked   map[string]bool // source tables replicated from this source
+
+	begin   *pglogrepl.BeginMessage // open transaction
+	tx      []changeEvent           // events of the open transaction
+	pending []changeEvent           // events of committed transactions not yet applied
+	since   time.Time               // when the first pending transaction committed
+	rank    map[string]int          // table → position in parents-first FK order
+
+	committed pglogrepl.LSN // end of the last decoded commit
+	flushed   pglogrepl.LSN // end of the last commit applied by all sinks
+	confirmed pglogrepl.LSN // last position reported to the source
+}
+
+// streamSource streams the source's slot into the sinks until ctx is
+// cancelled, reconnecting on errors. Pending batches are applied under
+// applyCtx, like the Kafka consumers' in-flight batches.
+func streamSource(ctx, applyCtx context.Context, src source) {
+	s := &pgoutputStream{src: src, tracked: make(map[string]bool)}
+	for _, t := range src.tableList() {
+		s.tracked[t] = true
+	}
+	log.Printf("  [pgoutput] %s: slot %s, publication %s", src.Site, src.Slot, src.Publication)
+	for ctx.Err() == nil {
+		err := s.stream(ctx, applyCtx)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("  [pgoutput] %s: %v", src.Site, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+	log.Printf("  [pgoutput] %s stopped", src.Site)
+}
+
+// stream runs one replication connection. It starts at the slot's confirmed
+// position; anything decoded but not flushed before is discarded and
+// received again.
+func (s *pgoutputStream) stream(ctx, applyCtx context.Context) error {
+	conn, err := pgconn.Connect(ctx, s.src.dsn()+"&replication=database")
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	s.relations = make(map[uint32]*pglogrepl.RelationMessage)
+	s.begin, s.tx, s.pending = nil, nil, nil
+	s.committed = s.flushed
+	err = pglogrepl.StartReplication(ctx, conn, s.src.Slot, 0, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", "publication_names '" + s.src.Publication + "'"},
+	})
+	if err != nil {
+		return fmt.Errorf("start replication: %w", err)
+	}
+
+	nextStatus := time.Now().Add(standbyStatusInterval)
+	for {
+		if len(s.pending) >= batchSize || (len(s.pending) > 0 && time.Since(s.since) >= batchLinger) {
+			if !s.flush(applyCtx, conn) {
+				return fmt.Errorf("batch not applied")
+			}
+		} else if len(s.pending) == 0 && s.committed > s.flushed {
+			// Only filtered or untracked commits since: nothing to apply.
+			s.flushed = s.committed
+		}
+		if time.Now().After(nextStatus) {
+			if err := s.sendStatus(ctx, conn); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(standbyStatusInterval)
+		}
+
+		deadline := nextStatus
+		if len(s.pending) > 0 && s.since.Add(batchLinger).Before(deadline) {
+			deadline = s.since.Add(batchLinger)
+		}
+		rctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := conn.ReceiveMessage(rctx)
+		cancel()
+		if ctx.Err() != nil {
+			if len(s.pending) > 0 {
+				s.flush(applyCtx, conn)
+			}
+			return ctx.Err()
+		}
+		if pgconn.Timeout(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("receive: %w", err)
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("server: %s", msg.Message)
+		case *pgproto3.CopyData:
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				ka, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("keepalive: %w", err)
+				}
+				if len(s.pending) == 0 && s.begin == nil && s.committed == s.flushed && ka.ServerWALEnd > s.flushed {
+					// Everything sent so far is applied: confirm up to the
+					// server's position so an idle slot retains no WAL.
+					s.committed, s.flushed = ka.ServerWALEnd, ka.ServerWALEnd
+				}
+				if ka.ReplyRequested {
+					nextStatus = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("xlog data: %w", err)
+				}
+				if err := s.decode(ctx, xld); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// decode handles one pgoutput message.
+func (s *pgoutputStream) decode(ctx context.Context, xld pglogrepl.XLogData) error {
+	m, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	switch m := m.(type) {
+	case *pglogrepl.RelationMessage:
+		s.relations[m.RelationID] = m
+	case *pglogrepl.BeginMessage:
+		s.begin, s.tx = m, nil
+	case *pglogrepl.CommitMessage:
+		if len(s.tx) > 0 {
+			if len(s.pending) == 0 {
+				s.since = time.Now()
+			}
+			s.pending = append(s.pending, s.tx...)
+		}
+		s.begin, s.tx = nil, nil
+		s.committed = m.TransactionEndLSN
+	case *pglogrepl.InsertMessage:
+		return s.add(ctx, xld, m.RelationID, "c", nil, m.Tuple)
+	case *pglogrepl.UpdateMessage:
+		return s.add(ctx, xld, m.RelationID, "u", m.OldTuple, m.NewTuple)
+	case *pglogrepl.DeleteMessage:
+		return s.add(ctx, xld, m.RelationID, "d", m.OldTuple, nil)
+	case *pglogrepl.TruncateMessage:
+		for _, id := range m.RelationIDs {
+			if err := s.add(ctx, xld, id, "t", nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add turns one row change into a changeEvent of the open transaction,
+// passing it through the table's filter, masking and mapping. Changes of
+// tables this source does not replicate are ignored. A failed filter lookup
+// ends the connection, so the transaction is received again.
+func (s *pgoutputStream) add(ctx context.Context, xld pglogrepl.XLogData, rel uint32, op string, before, after *pglogrepl.TupleData) error {
+	r, ok := s.relations[rel]
+	if !ok || r.Namespace != "public" || !s.tracked[r.RelationName] || s.begin == nil {
+		return nil
+	}
+	e := changeEvent{Table: r.RelationName, Site: s.src.Site, Op: op,
+		Before: tupleRow(r, before), After: tupleRow(r, after),
+		LSN: int64(xld.WALStart), TxID: int64(s.begin.Xid), TsMs: s.begin.CommitTime.UnixMilli(),
+		Topic: s.src.Slot, Offset: int64(s.begin.FinalLSN)}
+	noteFetched(s.src.Slot, e.Offset)
+	e, ok, err := filterEvent(ctx, e)
+	if err != nil {
+		return fmt.Errorf("filter %s: %w", e.Table, err)
+	}
+	if ok {
+		s.tx = append(s.tx, mapEvent(maskEvent(e)))
+	}
+	return nil
+}
+
+// tupleRow converts a pgoutput tuple into a row image with the JSON types
+// Debezium uses: booleans, numbers as float64, everything else (NUMERIC
+// included, as with decimal.handling.mode=string) as text. Unchanged TOAST
+// values are left out, so upserts keep the target's value.
+func tupleRow(r *pglogrepl.RelationMessage, t *pglogrepl.TupleData) map[string]interface{} {
+	if t == nil {
+		return nil
+	}
+	row := make(map[string]interface{}, len(t.Columns))
+	for i, c := range t.Columns {
+		if i >= len(r.Columns) {
+			break
+		}
+		col := r.Columns[i]
+		switch c.DataType {
+		case 'n':
+			row[col.Name] = nil
+		case 't':
+			row[col.Name] = textValue(col.DataType, string(c.Data))
+		}
+	}
+	return row
+}
+
+// textValue converts a column's text representation by type OID.
+func textValue(oid uint32, s string) interface{} {
+	switch oid {
+	case 16: // bool
+		return s == "t"
+	case 20, 21, 23, 26, 700, 701: // int8, int2, int4, oid, float4, float8
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// flush applies the pending events in source order, then checkpoints every
+// sink they went to and reports the end of the last commit as flushed. It
+// returns false when the batch was abandoned at the shutdown deadline.
+func (s *pgoutputStream) flush(ctx context.Context, conn *pgconn.PgConn) bool {
+	batch, end := s.pending, s.committed
+	last := batch[len(batch)-1].Offset
+	if failbackEnabled {
+		var err error
+		if batch, err = dropEchoes(ctx, s.src.dsn(), batch); err != nil {
+			log.Printf("  [pgoutput] %s: %v", s.src.Site, err)
+			return false
+		}
+	}
+	applied := make(map[string]bool)
+	for len(batch) > 0 {
+		n := 1
+		if batch[0].Op == "t" {
+			n = s.truncateRun(ctx, batch)
+		}
+		for n < len(batch) && batch[n].Table == batch[0].Table && batch[0].Op != "t" && batch[n].Op != "t" {
+			n++
+		}
+		table := batch[0].Table
+		throttle.admit(ctx, table, n)
+		if !applyEvents(ctx, sinkFor(table), table, batch[:n]) {
+			return false
+		}
+		applied[table] = true
+		batch = batch[n:]
+	}
+	pos := position{Topic: s.src.Slot, Offset: last, LSN: int64(end)}
+	for table := range applied {
+		if err := sinkFor(table).Checkpoint(ctx, pos); err != nil {
+			log.Printf("  [pgoutput] %s checkpoint: %v", table, err)
+			return false
+		}
+	}
+	s.pending = nil
+	s.flushed = end
+	noteApplied(s.src.Slot, last)
+	if err := s.sendStatus(ctx, conn); err != nil {
+		log.Printf("  [pgoutput] %s status update: %v", s.src.Site, err)
+	}
+	return true
+}
+
+// truncateRun orders the truncates of one TRUNCATE message (same LSN) at the
+// head of batch children-first, so the referencing rows are gone before the
+// referenced ones, and returns how many of them share the first one's sink
+// and are applied together in one Apply.
+func (s *pgoutputStream) truncateRun(ctx context.Context, batch []changeEvent) int {
+	n := 1
+	for n < len(batch) && batch[n].Op == "t" && batch[n].LSN == batch[0].LSN {
+		n++
+	}
+	if n > 1 {
+		rank := s.rank
+		if rank == nil {
+			g, err := loadFKGraph(ctx, pg2DSN)
+			rank = make(map[string]int, len(tables))
+			for i, t := range g.order(tables) {
+				rank[t] = i
+			}
+			if err != nil {
+				log.Printf("  [pgoutput] %s: truncate order: %v", s.src.Site, err)
+			} else {
+				s.rank = rank
+			}
+		}
+		sort.SliceStable(batch[:n], func(i, j int) bool {
+			return rank[batch[i].Table] > rank[batch[j].Table]
+		})
+	}
+	sink := sinkFor(batch[0].Table)
+	m := 1
+	for m < n && sinkFor(batch[m].Table) == sink {
+		m++
+	}
+	return m
+}
+
+// sendStatus reports the last applied commit to the source; the slot's
+// confirmed_flush_lsn follows it. Sinks that have not made their part
+// durable yet (laggingSink) hold the reported position back.
+func (s *pgoutputStream) sendStatus(ctx context.Context, conn *pgconn.PgConn) error {
+	lsn := s.flushed
+	for t := range s.tracked {
+		if l, ok := sinkFor(t).(laggingSink); ok {
+			if pos, behind := l.lag(s.src.Slot); behind && pglogrepl.LSN(pos.LSN) < lsn {
+				lsn = pglogrepl.LSN(pos.LSN)
+			}
+		}
+	}
+	if lsn < s.confirmed {
+		lsn = s.confirmed
+	}
+	s.confirmed = lsn
+	return pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: lsn, WALFlushPosition: lsn, WALApplyPosition: lsn,
+	})
+}
@@ -0,0 +1,113 @@
+// pgoutput_test.go — Tests for pgoutput tuple decoding and truncate ordering.
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestTextValue(t *testing.T) {
+	tests := []struct {
+		oid  uint32
+		in   string
+		want interface{}
+	}{
+		{16, "t", true},
+		{16, "f", false},
+		{20, "9007199254740993", float64(9007199254740993)},
+		{21, "-7", float64(-7)},
+		{23, "42", float64(42)},
+		{26, "16384", float64(16384)},
+		{700, "0.25", float64(0.25)},
+		{701, "1e+06", float64(1000000)},
+		{701, "NaN", "NaN"},          // compared as text below
+		{1700, "1234.50", "1234.50"}, // numeric stays text
+		{25, "hello", "hello"},
+		{1184, "2026-01-02 03:04:05+00", "2026-01-02 03:04:05+00"},
+		{23, "not-a-number", "not-a-number"},
+	}
+	for _, tt := range tests {
+		got := textValue(tt.oid, tt.in)
+		if f, ok := got.(float64); ok && f != f {
+			got = "NaN" // NaN never equals itself
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("textValue(%d, %q) = %#v, want %#v", tt.oid, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTupleRow(t *testing.T) {
+	rel := &pglogrepl.RelationMessage{Columns: []*pglogrepl.RelationMessageColumn{
+		{Name: "id", DataType: 23},
+		{Name: "name", DataType: 25},
+		{Name: "active", DataType: 16},
+		{Name: "notes", DataType: 25},
+	}}
+	tests := []struct {
+		name  string
+		tuple *pglogrepl.TupleData
+		want  map[string]interface{}
+	}{
+		{"no tuple", nil, nil},
+		{"all columns", &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{
+			{DataType: 't', Data: []byte("7")},
+			{DataType: 't', Data: []byte("r750")},
+			{DataType: 't', Data: []byte("t")},
+			{DataType: 'n'},
+		}}, map[string]interface{}{"id": float64(7), "name": "r750", "active": true, "notes": nil}},
+		{"unchanged toast left out", &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{
+			{DataType: 't', Data: []byte("7")},
+			{DataType: 't', Data: []byte("r750")},
+			{DataType: 't', Data: []byte("f")},
+			{DataType: 'u'},
+		}}, map[string]interface{}{"id": float64(7), "name": "r750", "active": false}},
+		{"extra tuple columns ignored", &pglogrepl.TupleData{Columns: []*pglogrepl.TupleDataColumn{
+			{DataType: 't', Data: []byte("1")}, {DataType: 'n'}, {DataType: 'n'}, {DataType: 'n'},
+			{DataType: 't', Data: []byte("x")},
+		}}, map[string]interface{}{"id": float64(1), "name": nil, "active": nil, "notes": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tupleRow(rel, tt.tuple); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tupleRow = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateRunChildrenFirst(t *testing.T) {
+	s := &pgoutputStream{rank: map[string]int{"devices": 0, "alerts": 1, "device_health": 2}}
+	tests := []struct {
+		name   string
+		tables []string
+		lsns   []int64
+		want   []string
+		n      int
+	}{
+		{"one truncate message", []string{"devices", "alerts", "device_health"}, []int64{5, 5, 5},
+			[]string{"device_health", "alerts", "devices"}, 3},
+		{"separate messages stay apart", []string{"devices", "alerts"}, []int64{5, 9},
+			[]string{"devices", "alerts"}, 1},
+		{"single table", []string{"alerts"}, []int64{5}, []string{"alerts"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batch []changeEvent
+			for i, table := range tt.tables {
+				batch = append(batch, changeEvent{Table: table, Op: "t", LSN: tt.lsns[i]})
+			}
+			n := s.truncateRun(context.Background(), batch)
+			var got []string
+			for _, e := range batch {
+				got = append(got, e.Table)
+			}
+			if n != tt.n || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("truncateRun = %d %v, want %d %v", n, got, tt.n, tt.want)
+			}
+		})
+	}
+}
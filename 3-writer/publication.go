@@ -0,0 +1,198 @@
+// publication.go — The writer owns each source's publication.
+// Before the slot is created the source's publication is created, or altered,
+// to publish exactly the configured tables (tables, or source.Tables), so the
+// publication, the Debezium include list and the writer's table list all come
+// from config.go. A publication FOR ALL TABLES, as the init SQL creates it,
+// is replaced by one FOR TABLE.
+//
+// The REPLICA IDENTITY of every published table is validated as well: updates
+// and deletes need at least a primary key, and tables with row filters or
+// failback conflict checks need FULL before images. Mismatches are fixed
+// with ALTER TABLE, or with WRITER_FIX_REPLICA_IDENTITY=false only reported,
+// and the writer refuses to start.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ensurePublication brings the source's publication and the replica
+// identities of its tables in line with the configuration.
+func ensurePublication(ctx context.Context, src source) error {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tbls := src.tableList()
+
+	rows, err := db.QueryContext(ctx, `SELECT t FROM unnest($1::text[]) t
+		WHERE to_regclass(quote_ident('public') || '.' || quote_ident(t)) IS NULL`, pq.Array(tbls))
+	if err != nil {
+		return err
+	}
+	missing, err := scanNames(rows)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("configured tables missing on %s: %s", src.Site, strings.Join(missing, ", "))
+	}
+
+	if err := syncPublication(ctx, db, src.Publication, tbls); err != nil {
+		return fmt.Errorf("publication %s: %w", src.Publication, err)
+	}
+	return checkReplicaIdentity(ctx, db, tbls)
+}
+
+// syncPublication creates the publication for exactly tbls, or alters it to
+// them, publishing all four operations. It logs what changed.
+func syncPublication(ctx context.Context, db *sql.DB, name string, tbls []string) error {
+	var allTables bool
+	err := db.QueryRowContext(ctx, "SELECT puballtables FROM pg_publication WHERE pubname=$1", name).Scan(&allTables)
+	if err == sql.ErrNoRows {
+		_, err = db.ExecContext(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", quoteIdent(name), quoteIdents(tbls)))
+		if err == nil {
+			log.Printf("  [publication] %s created for %d tables", name, len(tbls))
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if allTables {
+		// FOR ALL TABLES cannot be altered into a table list. Replacing it in
+		// one transaction keeps the name valid for a running connector.
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, q := range []string{
+			"DROP PUBLICATION " + quoteIdent(name),
+			fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", quoteIdent(name), quoteIdents(tbls)),
+		} {
+			if _, err := tx.ExecContext(ctx, q); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("  [publication] %s was FOR ALL TABLES, now FOR %d tables", name, len(tbls))
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT tablename FROM pg_publication_tables WHERE pubname=$1 AND schemaname='public'", name)
+	if err != nil {
+		return err
+	}
+	names, err := scanNames(rows)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(names))
+	for _, t := range names {
+		current[t] = true
+	}
+	var added, removed []string
+	for _, t := range tbls {
+		if !current[t] {
+			added = append(added, t)
+		}
+		delete(current, t)
+	}
+	for t := range current {
+		removed = append(removed, t)
+	}
+	sort.Strings(removed)
+	if len(added) > 0 || len(removed) > 0 {
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER PUBLICATION %s SET TABLE %s", quoteIdent(name), quoteIdents(tbls))); err != nil {
+			return err
+		}
+		log.Printf("  [publication] %s: added [%s], removed [%s]", name, strings.Join(added, ","), strings.Join(removed, ","))
+	} else {
+		log.Printf("  [publication] %s matches the %d configured tables", name, len(tbls))
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER PUBLICATION %s SET (publish = 'insert, update, delete, truncate')", quoteIdent(name)))
+	return err
+}
+
+// scanNames reads a single text column and closes the rows.
+func scanNames(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
+
+// wantsFullIdentity reports whether a table's changes need full before
+// images: row filters decide updates on them (see filter.go) and failback
+// conflict detection compares them (see conflict.go).
+func wantsFullIdentity(table string) bool {
+	return len(configFor(table).Where) > 0 || (failbackEnabled && !multiSource() && !isMapped(table))
+}
+
+// checkReplicaIdentity validates the replica identity of every table and
+// fixes or reports the mismatches.
+func checkReplicaIdentity(ctx context.Context, db *sql.DB, tbls []string) error {
+	rows, err := db.QueryContext(ctx, `SELECT c.relname, c.relreplident,
+			EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = 'public' AND c.relname = ANY($1)`, pq.Array(tbls))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var mismatches []string
+	for rows.Next() {
+		var table, ident string
+		var hasPK bool
+		if err := rows.Scan(&table, &ident, &hasPK); err != nil {
+			return err
+		}
+		var problem string
+		switch {
+		case ident == "f":
+		case wantsFullIdentity(table):
+			problem = "needs FULL for before images"
+		case ident == "n", ident == "d" && !hasPK:
+			problem = "has no replica identity: updates and deletes would fail on the source"
+		}
+		if problem == "" {
+			continue
+		}
+		if !fixReplicaIdentity {
+			mismatches = append(mismatches, fmt.Sprintf("%s (%s)", table, problem))
+			continue
+		}
+		fix := "FULL"
+		if !wantsFullIdentity(table) && hasPK {
+			fix = "DEFAULT"
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY %s", quoteIdent(table), fix)); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		log.Printf("  [publication] %s %s: REPLICA IDENTITY %s", table, problem, fix)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("replica identity mismatches: %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
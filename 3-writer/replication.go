@@ -4,74 +4,211 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// createSlot recreates the logical replication slot on postgres1 with the
-// configured name and pgoutput plugin, returning the LSN at which it starts.
+// createSlot recreates the source's logical replication slot with the
+// pgoutput plugin, returning the LSN at which it starts.
 // This is T1 in the zero-loss timeline: everything after this LSN is captured.
-func createSlot() string {
-	db, _ := sql.Open("postgres", pg1DSN)
+func createSlot(src source) string {
+	db, _ := sql.Open("postgres", src.dsn())
 	defer db.Close()
 
 	// Drop existing slot if any (idempotent restart)
 	db.Exec(fmt.Sprintf(`DO $$ BEGIN
 		IF EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name='%s')
 		THEN PERFORM pg_drop_replication_slot('%s');
-		END IF; END $$;`, slotName, slotName))
+		END IF; END $$;`, src.Slot, src.Slot))
 
 	var n, l string
 	if err := db.QueryRow(fmt.Sprintf(
 		"SELECT slot_name,lsn::TEXT FROM pg_create_logical_replication_slot('%s','pgoutput')",
-		slotName)).Scan(&n, &l); err != nil {
+		src.Slot)).Scan(&n, &l); err != nil {
 		log.Fatalf("  Slot failed: %v", err)
 	}
-	log.Printf("  Slot '%s' at LSN %s", n, l)
+	log.Printf("  Slot '%s' on %s at LSN %s", n, src.Site, l)
 	return l
 }
 
-// pgDump executes pg_dump against postgres1 for database omedb, writing a
-// custom-format dump file on disk and returning its path and duration.
+// pgDump executes pg_dump against a source database for the source's
+// configured tables (one -t each, their owned sequences included) and returns
+// the dump's path and duration. With dumpJobs > 1 the dump is a directory
+// dumped by that many parallel jobs, otherwise a custom-format file.
 // This is T2 in the zero-loss timeline: the MVCC snapshot sees all committed data.
-func pgDump() (string, time.Duration) {
-	f := "/tmp/omedb.dump"
+func pgDump(ctx context.Context, src source) (string, time.Duration) {
+	f := "/tmp/" + src.Site + ".dump"
+	args := []string{"-h", src.Host, "-p", src.Port, "-U", src.User, "-d", src.DB,
+		"--no-owner", "--no-privileges"}
+	if dumpJobs > 1 {
+		f += "dir"
+		args = append(args, "-F", "d", "-j", strconv.Itoa(dumpJobs))
+	} else {
+		args = append(args, "-F", "c")
+	}
+	args = append(args, "-f", f)
+	for _, t := range src.tableList() {
+		args = append(args, "-t", "public."+quoteIdent(t))
+	}
+	os.RemoveAll(f) // a directory dump refuses an existing target
 	start := time.Now()
-	cmd := exec.Command("pg_dump",
-		"-h", "postgres1", "-U", "postgres", "-d", "omedb",
-		"-F", "c", "-f", f, "--no-owner", "--no-privileges")
-	cmd.Env = append(os.Environ(), "PGPASSWORD=postgres")
+	cmd := exec.CommandContext(ctx, "pg_dump", args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+src.Password)
 	var se bytes.Buffer
 	cmd.Stderr = &se
 	if err := cmd.Run(); err != nil {
+		checkAborted(ctx, f)
 		log.Fatalf("  pg_dump: %v\n%s", err, se.String())
 	}
 	d := time.Since(start)
-	fi, _ := os.Stat(f)
-	log.Printf("  Dump: %d bytes in %v", fi.Size(), d)
+	log.Printf("  Dump: %d tables, %d bytes in %v (%d jobs)", len(src.tableList()), dumpSize(f), d, max(dumpJobs, 1))
 	return f, d
 }
 
-// pgRestore recreates the omedb database on postgres2 and restores the
-// provided dump file into it, returning the time taken.
-func pgRestore(df string) time.Duration {
+// checkAborted ends a bootstrap interrupted by SIGINT/SIGTERM: the dump
+// files are removed and the writer exits 1. The slot and postgres2 are left
+// as they are; the next start recreates the slot and restores again.
+func checkAborted(ctx context.Context, files ...string) {
+	if ctx.Err() == nil {
+		return
+	}
+	for _, f := range files {
+		os.RemoveAll(f)
+	}
+	log.Println("  Bootstrap interrupted, exiting")
+	os.Exit(1)
+}
+
+// dumpSize returns the size of a dump file or directory in bytes.
+func dumpSize(path string) int64 {
+	var n int64
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n += fi.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// pgRestore restores the dump into postgres2 with dumpJobs parallel jobs,
+// returning the time taken. By default the omedb database is recreated
+// first; with restoreDataOnly only the rows are restored into the existing
+// schema, after emptying every writer-owned table left by a previous
+// bootstrap. Any pg_restore error is fatal and logged as parsed from its
+// stderr.
+func pgRestore(ctx context.Context, df string) time.Duration {
 	start := time.Now()
-	db, _ := sql.Open("postgres", pg2AdminDSN)
-	db.Exec("DROP DATABASE IF EXISTS omedb")
-	db.Exec("CREATE DATABASE omedb")
-	db.Close()
+	args := []string{"-h", "postgres2", "-U", "postgres", "-d", "omedb",
+		"--no-owner", "--no-privileges", "-j", strconv.Itoa(max(dumpJobs, 1))}
+	if restoreDataOnly {
+		if err := emptyTarget(); err != nil {
+			log.Fatalf("  Restore: emptying postgres2: %v", err)
+		}
+		// Triggers (FK checks included) stay off while parallel jobs load
+		// tables in any order.
+		args = append(args, "--data-only", "--disable-triggers")
+	} else {
+		db, _ := sql.Open("postgres", pg2AdminDSN)
+		for _, q := range []string{"DROP DATABASE IF EXISTS omedb", "CREATE DATABASE omedb"} {
+			if _, err := db.Exec(q); err != nil {
+				log.Fatalf("  Restore: %s: %v", q, err)
+			}
+		}
+		db.Close()
+	}
 
-	cmd := exec.Command("pg_restore",
-		"-h", "postgres2", "-U", "postgres", "-d", "omedb",
-		"--no-owner", "--no-privileges", df)
+	cmd := exec.CommandContext(ctx, "pg_restore", append(args, df)...)
 	cmd.Env = append(os.Environ(), "PGPASSWORD=postgres")
-	cmd.Run()
+	var se bytes.Buffer
+	cmd.Stderr = &se
+	if err := cmd.Run(); err != nil {
+		checkAborted(ctx, df)
+		errs := restoreErrors(se.String())
+		for _, e := range errs {
+			log.Printf("  pg_restore: %s", e)
+		}
+		log.Fatalf("  Restore failed (%v): %d errors", err, len(errs))
+	}
 
 	d := time.Since(start)
-	log.Printf("  Restore: %v", d)
+	mode := "full"
+	if restoreDataOnly {
+		mode = "data-only"
+	}
+	log.Printf("  Restore: %v (%s)", d, mode)
 	return d
 }
+
+// emptyTarget truncates every table on postgres2 the writer owns, as a
+// recreated database would have them: the configured tables, their mapped
+// targets and history tables, and every _cdc_ table (checkpoints, key state,
+// bootstrap marker, conflicts, dead letters, origin tags).
+func emptyTarget() error {
+	db, err := sql.Open("postgres", pg2DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var candidates []string
+	for _, t := range tables {
+		schema, name := targetOf(t)
+		candidates = append(candidates, "public."+quoteIdent(t),
+			quoteIdent(schema)+"."+quoteIdent(name), quoteIdent(schema)+"."+quoteIdent(name+"_history"))
+	}
+	rows, err := db.Query(`SELECT format('%I.%I', n.nspname, c.relname) FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND c.relname LIKE '\_cdc\_%'`)
+	if err != nil {
+		return err
+	}
+	owned, err := scanNames(rows)
+	if err != nil {
+		return err
+	}
+	existing := owned
+	for _, t := range candidates {
+		var ok bool
+		if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", t).Scan(&ok); err != nil {
+			return err
+		}
+		if ok && !contains(existing, t) {
+			existing = append(existing, t)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	_, err = db.Exec("TRUNCATE " + strings.Join(existing, ", "))
+	return err
+}
+
+// restoreErrors extracts the errors from pg_restore's stderr, each with the
+// statement that failed.
+func restoreErrors(stderr string) []string {
+	var errs []string
+	for _, line := range strings.Split(stderr, "\n") {
+		switch {
+		case strings.HasPrefix(line, "pg_restore: error: "):
+			errs = append(errs, strings.TrimPrefix(line, "pg_restore: error: "))
+		case strings.HasPrefix(line, "Command was: ") && len(errs) > 0:
+			cmd := strings.TrimPrefix(line, "Command was: ")
+			if len(cmd) > 200 {
+				cmd = cmd[:200] + "..."
+			}
+			errs[len(errs)-1] += " [" + cmd + "]"
+		}
+	}
+	if len(errs) == 0 && strings.TrimSpace(stderr) != "" {
+		errs = append(errs, strings.TrimSpace(stderr))
+	}
+	return errs
+}
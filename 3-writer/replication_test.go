@@ -0,0 +1,41 @@
+// replication_test.go — Tests for parsing pg_restore's stderr.
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRestoreErrors(t *testing.T) {
+	long := "COPY public.devices (id, name) FROM stdin;" + strings.Repeat(" ", 200)
+	tests := []struct {
+		name   string
+		stderr string
+		want   []string
+	}{
+		{"clean", "", nil},
+		{"whitespace only", "\n  \n", nil},
+		{"error with command",
+			"pg_restore: while PROCESSING TOC:\n" +
+				"pg_restore: error: could not execute query: ERROR:  relation \"devices\" already exists\n" +
+				"Command was: CREATE TABLE public.devices (id integer);\n",
+			[]string{`could not execute query: ERROR:  relation "devices" already exists [CREATE TABLE public.devices (id integer);]`}},
+		{"several errors",
+			"pg_restore: error: first\nCommand was: A;\npg_restore: error: second\n",
+			[]string{"first [A;]", "second"}},
+		{"long command truncated",
+			"pg_restore: error: copy failed\nCommand was: " + long + "\n",
+			[]string{"copy failed [" + long[:200] + "...]"}},
+		{"command without error ignored", "Command was: A;\n", []string{"Command was: A;"}},
+		{"unparsed stderr kept", "pg_restore: [archiver] unsupported version\n",
+			[]string{"pg_restore: [archiver] unsupported version"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restoreErrors(tt.stderr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restoreErrors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
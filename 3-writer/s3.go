@@ -0,0 +1,116 @@
+// s3.go — Minimal S3-compatible object upload (PUT Object, SigV4).
+// Used by the archive sink to ship closed files to MinIO, Ceph, AWS S3, etc.
+// Only single-part uploads are supported, which is plenty for rolled files.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// s3Config describes an S3-compatible bucket. Endpoint is the scheme and host
+// (e.g. "http://minio:9000"); objects are addressed path-style.
+type s3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// enabled reports whether an S3 target is configured.
+func (c s3Config) enabled() bool { return c.Endpoint != "" && c.Bucket != "" }
+
+// s3Put uploads body to key (relative to the configured prefix) and returns
+// the s3:// URL of the object.
+func s3Put(ctx context.Context, c s3Config, key string, body []byte) (string, error) {
+	key = strings.TrimPrefix(strings.TrimSuffix(c.Prefix, "/")+"/"+key, "/")
+	path := "/" + c.Bucket + "/" + escapeS3Path(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(c.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	signS3(req, c, path, body, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		rb, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("s3 put %s: %d %s", key, resp.StatusCode, strings.TrimSpace(string(rb)))
+	}
+	return "s3://" + c.Bucket + "/" + key, nil
+}
+
+// signS3 adds AWS Signature Version 4 headers to req.
+func signS3(req *http.Request, c s3Config, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), day)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		c.AccessKey, scope, sig))
+}
+
+// escapeS3Path URI-encodes each segment of an object key as SigV4 requires:
+// everything except unreserved characters is percent-encoded.
+func escapeS3Path(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~', ch == '/':
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,176 @@
+// sequences.go — Keeps postgres2's sequences at or above the sources'.
+// CDC upserts write explicit ids, so the target sequences behind SERIAL and
+// identity columns never move on their own and the first INSERT made on
+// postgres2 after cutover would collide with a replicated row. The sequences
+// owned by replicated columns are read from each source's catalog (state as
+// of now, not as of the dump) and every target sequence is advanced to the
+// highest of the source values and the target column's MAX. Sequences are
+// only ever moved forward. Runs every sequenceSyncInterval and at cutover;
+// with failback postgres1's sequences are advanced past postgres2's as well.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ownedSequence is a source sequence owned by a column (SERIAL or identity).
+type ownedSequence struct {
+	Table, Column string
+	Value         int64 // last_value, 0 if never called
+}
+
+// sourceSequences returns the sequences owned by columns of the replicated
+// tables on a source.
+func sourceSequences(ctx context.Context, src source) ([]ownedSequence, error) {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// deptype 'a' links a SERIAL's sequence to its column, 'i' an identity's.
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, a.attname, COALESCE(ps.last_value, 0)
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_namespace sn ON sn.oid = s.relnamespace
+		JOIN pg_sequences ps ON ps.schemaname = sn.nspname AND ps.sequencename = s.relname
+		JOIN pg_class c ON c.oid = d.refobjid
+		JOIN pg_namespace cn ON cn.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = d.refobjsubid
+		WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+		  AND d.deptype IN ('a', 'i') AND cn.nspname = 'public' AND c.relname = ANY($1)`,
+		pq.Array(tables))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ownedSequence
+	for rows.Next() {
+		var s ownedSequence
+		if err := rows.Scan(&s.Table, &s.Column, &s.Value); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// syncSequences advances the target sequence of every source-owned sequence
+// and returns how many it moved.
+func syncSequences(ctx context.Context) (int, error) {
+	want, order, err := wantedSequences(ctx, sources)
+	if err != nil {
+		return 0, err
+	}
+	return advanceSequences(ctx, pg2DSN, want, order, func(table, col string) (string, string, bool) {
+		if !keepsColumn(table, col) {
+			return "", "", false
+		}
+		schema, name := targetOf(table)
+		return quoteIdent(schema) + "." + quoteIdent(name), targetColumn(configFor(table), col), true
+	})
+}
+
+// syncFailbackSequences advances postgres1's sequences of the failback
+// tables past postgres2's, so OME's next inserts after failback do not
+// collide with rows created on postgres2.
+func syncFailbackSequences(ctx context.Context) (int, error) {
+	want, order, err := wantedSequences(ctx, []source{failback})
+	if err != nil {
+		return 0, err
+	}
+	tbls := failbackTables()
+	return advanceSequences(ctx, failbackDSN(), want, order, func(table, col string) (string, string, bool) {
+		return "public." + quoteIdent(table), col, contains(tbls, table)
+	})
+}
+
+// wantedSequences returns the highest value per table column across the
+// given databases' owned sequences, and the columns in discovery order.
+func wantedSequences(ctx context.Context, srcs []source) (map[[2]string]int64, [][2]string, error) {
+	want := make(map[[2]string]int64)
+	var order [][2]string
+	for _, src := range srcs {
+		seqs, err := sourceSequences(ctx, src)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", src.Site, err)
+		}
+		for _, s := range seqs {
+			k := [2]string{s.Table, s.Column}
+			if _, ok := want[k]; !ok {
+				order = append(order, k)
+			}
+			want[k] = max(want[k], s.Value)
+		}
+	}
+	return want, order, nil
+}
+
+// advanceSequences moves the sequence behind each wanted column of the
+// database at dsn to at least the wanted value and the column's MAX. target
+// resolves a source table column to the quoted table and column there, or
+// false to skip it.
+func advanceSequences(ctx context.Context, dsn string, want map[[2]string]int64, order [][2]string,
+	target func(table, col string) (string, string, bool)) (int, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	moved := 0
+	for _, k := range order {
+		table, col, ok := target(k[0], k[1])
+		if !ok {
+			continue
+		}
+		var seq sql.NullString
+		if err := db.QueryRowContext(ctx, "SELECT pg_get_serial_sequence($1, $2)", table, col).Scan(&seq); err != nil {
+			return moved, fmt.Errorf("%s.%s: %w", k[0], k[1], err)
+		}
+		if !seq.Valid {
+			continue // target column has no sequence of its own
+		}
+		var next, current int64
+		err := db.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT GREATEST($1::bigint, (SELECT COALESCE(MAX(%s), 0) FROM %s)),
+			       (SELECT COALESCE(last_value, 0) FROM pg_sequences
+			        WHERE format('%%I.%%I', schemaname, sequencename)::regclass = $2::regclass)`,
+			quoteIdent(col), table), want[k], seq.String).Scan(&next, &current)
+		if err != nil {
+			return moved, fmt.Errorf("%s.%s: %w", k[0], k[1], err)
+		}
+		if next <= current {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "SELECT setval($1, $2, true)", seq.String, next); err != nil {
+			return moved, fmt.Errorf("%s: %w", seq.String, err)
+		}
+		log.Printf("  [sequences] %s %d → %d", seq.String, current, next)
+		moved++
+	}
+	return moved, nil
+}
+
+// syncSequencesLoop calls run (syncSequences or syncFailbackSequences) every
+// sequenceSyncInterval until ctx is cancelled.
+func syncSequencesLoop(ctx context.Context, run func(context.Context) (int, error)) {
+	if sequenceSyncInterval <= 0 {
+		return
+	}
+	for {
+		if _, err := run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("  [sequences] %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sequenceSyncInterval):
+		}
+	}
+}
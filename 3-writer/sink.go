@@ -0,0 +1,342 @@
+// sink.go — Sink interface, change-event model, and sink registry.
+// A sink is any target the CDC stream is applied to. The consumer loop only
+// talks to this interface; each target lives in its own sink_*.go file.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// changeEvent is one decoded Debezium change record for a single row.
+type changeEvent struct {
+	Table  string                 // source table name
+	Site   string                 // source site id (see sources in config.go)
+	Schema string                 // target schema (set by mapEvent)
+	Target string                 // target table name (set by mapEvent)
+	Key    []string               // target primary key columns (set by mapEvent)
+	Op     string                 // c=create, r=read, u=update, d=delete, t=truncate
+	Before map[string]interface{} // row image before the change (nil for c/r/t)
+	After  map[string]interface{} // row image after the change (nil for d/t)
+	LSN    int64                  // source.lsn of the change
+	TxID   int64                  // source.txId of the change
+	TsMs   int64                  // source.ts_ms — commit time on the source
+	Topic  string                 // Kafka topic the event was read from
+	Offset int64                  // Kafka offset of the event
+	Merge  map[string]string      // column → SQL merging a conflicting update (see conflict.go)
+}
+
+// row returns the row image that identifies the event: after for
+// inserts/updates, before for deletes.
+func (e changeEvent) row() map[string]interface{} {
+	if e.Op == "d" {
+		return e.Before
+	}
+	return e.After
+}
+
+// position identifies how far a topic has been applied to a sink.
+type position struct {
+	Topic  string
+	Offset int64 // last applied Kafka offset
+	LSN    int64 // source LSN of the event at Offset
+}
+
+// Sink applies batches of change events to a target.
+//
+// Apply is called with the events of a single table in source order. It
+// returns an error only when the batch as a whole could not be applied
+// (target unreachable, commit failed); the consumer then retries the batch.
+// Flush makes everything applied so far durable, Checkpoint records the
+// position up to which the stream has been applied and flushed, and Close
+// releases the sink's resources. Sinks are shared by all table consumers and
+// must be safe for concurrent use.
+type Sink interface {
+	Apply(ctx context.Context, batch []changeEvent) error
+	Flush(ctx context.Context) error
+	Checkpoint(ctx context.Context, pos position) error
+	Close() error
+}
+
+// laggingSink is implemented by sinks whose checkpoint can trail what they
+// applied (the Parquet archive, see sink_archive.go). lag returns the
+// position a topic is durable up to while it is behind; the pgoutput stream
+// confirms its slot no further.
+type laggingSink interface {
+	lag(topic string) (position, bool)
+}
+
+// decodeEvent parses a Debezium JSON message value into a changeEvent.
+// It accepts both the bare payload and the {"schema":..,"payload":..} envelope.
+func decodeEvent(table string, value []byte) (changeEvent, error) {
+	var ev map[string]interface{}
+	if err := json.Unmarshal(value, &ev); err != nil {
+		return changeEvent{}, err
+	}
+	p := ev
+	if pp, ok := ev["payload"].(map[string]interface{}); ok {
+		p = pp
+	}
+	e := changeEvent{Table: table}
+	e.Op, _ = p["op"].(string)
+	e.After, _ = p["after"].(map[string]interface{})
+	e.Before, _ = p["before"].(map[string]interface{})
+	if src, ok := p["source"].(map[string]interface{}); ok {
+		e.LSN = jsonInt(src["lsn"])
+		e.TxID = jsonInt(src["txId"])
+		e.TsMs = jsonInt(src["ts_ms"])
+	}
+	if e.Op == "" {
+		return e, errors.New("missing op")
+	}
+	return e, nil
+}
+
+// jsonInt converts a JSON number (decoded as float64) to int64, returning 0
+// for anything else.
+func jsonInt(v interface{}) int64 {
+	if n, ok := v.(float64); ok {
+		return int64(n)
+	}
+	return 0
+}
+
+// contains reports whether s is in list.
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ═══════════════════════════════════════════════════════════════
+// SINK REGISTRY
+// ═══════════════════════════════════════════════════════════════
+
+// sinkFactories constructs sinks by the name used in tableConfigs.
+// To add a new target, implement Sink and register its constructor here.
+var sinkFactories = map[string]func() (Sink, error){
+	"postgres2": func() (Sink, error) { return newPostgresSink(pg2DSN) },
+	"sqlite":    func() (Sink, error) { return newSQLiteSink(sqlitePath) },
+	"archive":   func() (Sink, error) { return newArchiveSink(archiveDir, archiveFormat) },
+	"webhook":   func() (Sink, error) { return newWebhookSink(webhookEndpoints) },
+	"republish": func() (Sink, error) { return newKafkaSink(republishRules) },
+}
+
+// checkpointReader returns the position a sink last checkpointed for a
+// topic; ok is false when it has none yet.
+type checkpointReader func(ctx context.Context, topic string) (pos position, ok bool, err error)
+
+// checkpointReaders read back what sinks record with Checkpoint, by the name
+// used in tableConfigs. Sinks that keep no checkpoints (webhook, republish)
+// have no reader.
+var checkpointReaders = map[string]checkpointReader{
+	"postgres2": pgCheckpoints(pg2DSN),
+	"sqlite":    sqliteCheckpoints(sqlitePath),
+	"archive":   archiveCheckpoints(archiveDir),
+}
+
+// errNoCheckpoints is returned for tables routed only to sinks that keep no
+// checkpoints.
+var errNoCheckpoints = errors.New("no sink of the table keeps checkpoints")
+
+// sinkCheckpoints returns a reader of how far a table routed to the named
+// sinks has been applied: the lowest checkpoint among them, and none as long
+// as one of them has none.
+func sinkCheckpoints(names []string) checkpointReader {
+	return func(ctx context.Context, topic string) (position, bool, error) {
+		var min position
+		found := false
+		for _, n := range names {
+			read, ok := checkpointReaders[n]
+			if !ok {
+				continue
+			}
+			pos, ok, err := read(ctx, topic)
+			if err != nil {
+				return position{}, false, fmt.Errorf("%s: %w", n, err)
+			}
+			if !ok {
+				return position{}, false, nil
+			}
+			if !found || pos.Offset < min.Offset {
+				min = pos
+			}
+			found = true
+		}
+		if !found {
+			return position{}, false, errNoCheckpoints
+		}
+		return min, true, nil
+	}
+}
+
+// openSinksMap holds every sink opened by openSinks, keyed by name, and
+// fanouts the fanoutSink of every table routed to more than one of them.
+var (
+	openSinksMap = make(map[string]Sink)
+	fanouts      = make(map[string]*fanoutSink)
+	openSinksMu  sync.Mutex
+)
+
+// openSinks opens every sink referenced by defaultSinks or tableConfigs,
+// exiting fatally if a name is unknown or a sink cannot be opened.
+func openSinks() {
+	openSinksMu.Lock()
+	defer openSinksMu.Unlock()
+	for _, t := range tables {
+		for _, name := range configFor(t).Sinks {
+			if _, ok := openSinksMap[name]; ok {
+				continue
+			}
+			f, ok := sinkFactories[name]
+			if !ok {
+				log.Fatalf("  Unknown sink %q for table %s", name, t)
+			}
+			s, err := f()
+			if err != nil {
+				log.Fatalf("  Sink %s: %v", name, err)
+			}
+			openSinksMap[name] = s
+			log.Printf("  Sink %s opened", name)
+		}
+	}
+}
+
+// closeSinks flushes and closes every open sink.
+func closeSinks(ctx context.Context) {
+	openSinksMu.Lock()
+	defer openSinksMu.Unlock()
+	for name, s := range openSinksMap {
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("  [sink] %s flush: %v", name, err)
+		}
+		if err := s.Close(); err != nil {
+			log.Printf("  [sink] %s close: %v", name, err)
+		}
+		delete(openSinksMap, name)
+	}
+	fanouts = make(map[string]*fanoutSink)
+}
+
+// sinkFor returns the sink the given table is applied to. Tables routed to
+// more than one sink get a fanoutSink over them in configured order, the
+// same one on every call so its progress survives retries.
+func sinkFor(table string) Sink {
+	openSinksMu.Lock()
+	defer openSinksMu.Unlock()
+	names := configFor(table).Sinks
+	if len(names) == 1 {
+		return openSinksMap[names[0]]
+	}
+	if f, ok := fanouts[table]; ok {
+		return f
+	}
+	f := &fanoutSink{done: make(map[batchKey][]bool)}
+	for _, n := range names {
+		f.names = append(f.names, n)
+		f.sinks = append(f.sinks, openSinksMap[n])
+	}
+	fanouts[table] = f
+	return f
+}
+
+// fanoutSink applies every batch to several sinks in order. A batch is only
+// considered applied once all sinks accepted it. When a sink fails, the
+// retry of the batch skips the sinks that already applied it, so sinks that
+// are not idempotent (archive, webhook, republish) see it only once.
+type fanoutSink struct {
+	names []string
+	sinks []Sink
+
+	mu   sync.Mutex
+	done map[batchKey][]bool // batches partially applied: which sinks have them
+}
+
+// batchKey identifies a batch across retries.
+type batchKey struct {
+	topic       string
+	first, last int64 // offsets of the first and last event
+	firstLSN    int64
+	n           int
+}
+
+func keyOf(batch []changeEvent) batchKey {
+	first, last := batch[0], batch[len(batch)-1]
+	return batchKey{topic: first.Topic, first: first.Offset, last: last.Offset, firstLSN: first.LSN, n: len(batch)}
+}
+
+func (f *fanoutSink) Apply(ctx context.Context, batch []changeEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	k := keyOf(batch)
+	f.mu.Lock()
+	done := f.done[k]
+	f.mu.Unlock()
+	if done == nil {
+		done = make([]bool, len(f.sinks))
+	}
+	var failed error
+	for i, s := range f.sinks {
+		if done[i] {
+			continue
+		}
+		if err := s.Apply(ctx, batch); err != nil {
+			failed = fmt.Errorf("%s: %w", f.names[i], err)
+			break
+		}
+		done[i] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if failed != nil {
+		f.done[k] = done
+		return failed
+	}
+	delete(f.done, k)
+	return nil
+}
+
+func (f *fanoutSink) Flush(ctx context.Context) error {
+	for i, s := range f.sinks {
+		if err := s.Flush(ctx); err != nil {
+			return fmt.Errorf("%s: %w", f.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (f *fanoutSink) Checkpoint(ctx context.Context, pos position) error {
+	for i, s := range f.sinks {
+		if err := s.Checkpoint(ctx, pos); err != nil {
+			return fmt.Errorf("%s: %w", f.names[i], err)
+		}
+	}
+	return nil
+}
+
+// lag returns the furthest-behind lag of the member sinks.
+func (f *fanoutSink) lag(topic string) (position, bool) {
+	var min position
+	behind := false
+	for _, s := range f.sinks {
+		l, ok := s.(laggingSink)
+		if !ok {
+			continue
+		}
+		if pos, ok := l.lag(topic); ok && (!behind || pos.LSN < min.LSN) {
+			min, behind = pos, true
+		}
+	}
+	return min, behind
+}
+
+// Close is a no-op: the member sinks are owned by openSinksMap.
+func (f *fanoutSink) Close() error { return nil }
@@ -0,0 +1,536 @@
+// sink_archive.go — Append-only archive sink for audit history.
+// Every change event is written to rolling NDJSON or Parquet files under
+// archiveDir/<table>/date=YYYY-MM-DD/, one file set per topic, with source
+// LSN and transaction id per row so archives can be replayed. Closed files
+// are listed in archiveDir/manifest.ndjson and, when archiveS3 is configured,
+// uploaded to the bucket and removed locally.
+//
+// Data is written to "<file>.open" until the file rolls. NDJSON rows are
+// fsynced on every Flush, and .open files left behind by a crash are adopted
+// on startup: trimmed to their last complete row, closed and listed like any
+// other. A Parquet file is unreadable until its footer is written, so the
+// checkpoint of a topic never moves past the start of its open Parquet
+// files; their orphans are removed on startup and re-read from Kafka (or
+// the slot, which is only confirmed up to the checkpoint, see durable).
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// archiveRecord is one archived change event. Before/After are kept as raw
+// JSON for NDJSON and as JSON text columns for Parquet.
+type archiveRecord struct {
+	Table       string          `json:"table" parquet:"table"`
+	Op          string          `json:"op" parquet:"op"`
+	LSN         int64           `json:"lsn" parquet:"lsn"`
+	TxID        int64           `json:"tx_id" parquet:"tx_id"`
+	SourceTsMs  int64           `json:"source_ts_ms" parquet:"source_ts_ms"`
+	KafkaTopic  string          `json:"kafka_topic" parquet:"kafka_topic"`
+	KafkaOffset int64           `json:"kafka_offset" parquet:"kafka_offset"`
+	Before      json.RawMessage `json:"before,omitempty" parquet:"-"`
+	After       json.RawMessage `json:"after,omitempty" parquet:"-"`
+	BeforeJSON  string          `json:"-" parquet:"before,optional,zstd"`
+	AfterJSON   string          `json:"-" parquet:"after,optional,zstd"`
+}
+
+// archiveManifestEntry describes one closed archive file.
+type archiveManifestEntry struct {
+	Table       string    `json:"table"`
+	Topic       string    `json:"topic"` // the offsets below are of this topic
+	Date        string    `json:"date"`
+	Format      string    `json:"format"`
+	Location    string    `json:"location"`
+	Rows        int64     `json:"rows"`
+	Bytes       int64     `json:"bytes"`
+	MinLSN      int64     `json:"min_lsn"`
+	MaxLSN      int64     `json:"max_lsn"`
+	FirstOffset int64     `json:"first_offset"`
+	LastOffset  int64     `json:"last_offset"`
+	OpenedAt    time.Time `json:"opened_at"`
+	ClosedAt    time.Time `json:"closed_at"`
+}
+
+// archiveFile is the currently open file of one table/date/topic partition.
+type archiveFile struct {
+	entry archiveManifestEntry
+	path  string // final path; data is written to path+".open" until closed
+	f     *os.File
+	buf   *bufio.Writer                         // ndjson
+	pw    *parquet.GenericWriter[archiveRecord] // parquet
+
+	before    position // topic checkpoint when the file was opened
+	hasBefore bool     // false when the topic had no checkpoint yet
+}
+
+// archiveSink writes change history to rolling files.
+type archiveSink struct {
+	dir    string
+	format string
+
+	mu      sync.Mutex
+	open    map[string]*archiveFile // partitionKey → open file
+	applied map[string]position     // topic → last position passed to Checkpoint
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newArchiveSink prepares the archive directory and starts the time-based roller.
+func newArchiveSink(dir, format string) (*archiveSink, error) {
+	if format != "ndjson" && format != "parquet" {
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &archiveSink{dir: dir, format: format, open: make(map[string]*archiveFile),
+		applied: make(map[string]position), stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.recoverOpen(context.Background()); err != nil {
+		return nil, fmt.Errorf("recover open files: %w", err)
+	}
+	go s.roller()
+	return s, nil
+}
+
+// recoverOpen deals with the .open files a crash left behind. NDJSON files
+// are cut after their last complete row and closed; Parquet files have no
+// footer and are removed, their rows lie beyond the topic's checkpoint.
+func (s *archiveSink) recoverOpen(ctx context.Context) error {
+	var orphans []string
+	err := filepath.WalkDir(s.dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, ".open") {
+			orphans = append(orphans, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, open := range orphans {
+		path := strings.TrimSuffix(open, ".open")
+		if strings.HasSuffix(path, ".parquet") {
+			log.Printf("  [archive] removing unfinished %s; its rows are re-read from the checkpoint", open)
+			if err := os.Remove(open); err != nil {
+				return err
+			}
+			continue
+		}
+		entry, err := adoptNDJSON(open)
+		if err != nil {
+			return fmt.Errorf("%s: %w", open, err)
+		}
+		if entry.Rows == 0 {
+			if err := os.Remove(open); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("  [archive] adopting %s (%d rows)", open, entry.Rows)
+		if err := s.publish(ctx, path, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adoptNDJSON truncates an orphaned NDJSON file after its last complete row
+// and rebuilds its manifest entry from the rows.
+func adoptNDJSON(open string) (archiveManifestEntry, error) {
+	var m archiveManifestEntry
+	b, err := os.ReadFile(open)
+	if err != nil {
+		return m, err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		b = b[:i+1]
+		if err := os.Truncate(open, int64(len(b))); err != nil {
+			return m, err
+		}
+	}
+	info, err := os.Stat(open)
+	if err != nil {
+		return m, err
+	}
+	m = archiveManifestEntry{Format: "ndjson", Bytes: int64(len(b)),
+		Date: strings.TrimPrefix(filepath.Base(filepath.Dir(open)), "date="), OpenedAt: info.ModTime().UTC()}
+	if ts, err := time.Parse("20060102T150405", strings.SplitN(strings.TrimPrefix(filepath.Base(open), "part-"), "-", 2)[0]); err == nil {
+		m.OpenedAt = ts
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec archiveRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return m, err
+		}
+		if m.Rows == 0 {
+			m.Table, m.Topic, m.FirstOffset, m.MinLSN = rec.Table, rec.KafkaTopic, rec.KafkaOffset, rec.LSN
+		}
+		if rec.LSN < m.MinLSN {
+			m.MinLSN = rec.LSN
+		}
+		if rec.LSN > m.MaxLSN {
+			m.MaxLSN = rec.LSN
+		}
+		m.LastOffset = rec.KafkaOffset
+		m.Rows++
+	}
+	return m, nil
+}
+
+// partitionKey identifies the open file an event belongs to. Files are kept
+// per topic so that their offset range in the manifest is meaningful when
+// several sources feed one table.
+func partitionKey(table, date, topic string) string {
+	return table + "/" + date + "/" + topic
+}
+
+// Apply appends each event to its table/date/topic partition, rolling files
+// that exceed archiveRollBytes.
+func (s *archiveSink) Apply(ctx context.Context, batch []changeEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range batch {
+		ts := time.Now().UTC()
+		if e.TsMs > 0 {
+			ts = time.UnixMilli(e.TsMs).UTC()
+		}
+		date := ts.Format("2006-01-02")
+		af, err := s.file(e.Table, date, e.Topic, e.Offset)
+		if err != nil {
+			return err
+		}
+		if err := s.write(af, e); err != nil {
+			return err
+		}
+		if af.entry.Bytes >= archiveRollBytes {
+			if err := s.roll(ctx, partitionKey(e.Table, date, e.Topic)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// file returns the open file for a partition, creating it if needed.
+func (s *archiveSink) file(table, date, topic string, offset int64) (*archiveFile, error) {
+	key := partitionKey(table, date, topic)
+	if af, ok := s.open[key]; ok {
+		return af, nil
+	}
+	dir := filepath.Join(s.dir, table, "date="+date)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("part-%s-%s-%d.%s", now.Format("20060102T150405"), topic, offset, s.format)
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path+".open", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	af := &archiveFile{path: path, f: f, entry: archiveManifestEntry{
+		Table: table, Topic: topic, Date: date, Format: s.format, OpenedAt: now, FirstOffset: offset}}
+	af.before, af.hasBefore = s.applied[topic]
+	if !af.hasBefore {
+		af.before, af.hasBefore, err = archiveCheckpoints(s.dir)(context.Background(), topic)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if s.format == "parquet" {
+		af.pw = parquet.NewGenericWriter[archiveRecord](f, parquet.MaxRowsPerRowGroup(archiveRowGroupRows))
+	} else {
+		af.buf = bufio.NewWriterSize(f, 1<<20)
+	}
+	s.open[key] = af
+	return af, nil
+}
+
+// write appends one event to an open file and updates its manifest stats.
+func (s *archiveSink) write(af *archiveFile, e changeEvent) error {
+	rec := archiveRecord{Table: e.Table, Op: e.Op, LSN: e.LSN, TxID: e.TxID,
+		SourceTsMs: e.TsMs, KafkaTopic: e.Topic, KafkaOffset: e.Offset}
+	if e.Before != nil {
+		rec.Before, _ = json.Marshal(e.Before)
+	}
+	if e.After != nil {
+		rec.After, _ = json.Marshal(e.After)
+	}
+
+	var n int
+	if af.pw != nil {
+		rec.BeforeJSON, rec.AfterJSON = string(rec.Before), string(rec.After)
+		if _, err := af.pw.Write([]archiveRecord{rec}); err != nil {
+			return err
+		}
+		n = len(rec.Before) + len(rec.After) + 64 // estimate; compressed on flush
+	} else {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err := af.buf.Write(b); err != nil {
+			return err
+		}
+		n = len(b)
+	}
+
+	m := &af.entry
+	if m.Rows == 0 || e.LSN < m.MinLSN {
+		m.MinLSN = e.LSN
+	}
+	if e.LSN > m.MaxLSN {
+		m.MaxLSN = e.LSN
+	}
+	m.LastOffset = e.Offset
+	m.Rows++
+	m.Bytes += int64(n)
+	return nil
+}
+
+// roll closes the open file of a partition, records it in the manifest and
+// uploads it when S3 is configured.
+func (s *archiveSink) roll(ctx context.Context, key string) error {
+	af, ok := s.open[key]
+	if !ok {
+		return nil
+	}
+	delete(s.open, key)
+
+	if af.pw != nil {
+		if err := af.pw.Close(); err != nil {
+			return err
+		}
+	} else if err := af.buf.Flush(); err != nil {
+		return err
+	}
+	if err := af.f.Sync(); err != nil {
+		return err
+	}
+	if err := af.f.Close(); err != nil {
+		return err
+	}
+	if err := s.publish(ctx, af.path, af.entry); err != nil {
+		return err
+	}
+	if af.pw == nil {
+		return nil
+	}
+	// The topic's checkpoint may have been held back by this file.
+	if pos, ok := s.durable(af.entry.Topic); ok {
+		return s.writeCheckpoint(pos)
+	}
+	return nil
+}
+
+// publish renames a finished path+".open" file to path, uploads it when S3
+// is configured and lists it in the manifest.
+func (s *archiveSink) publish(ctx context.Context, path string, m archiveManifestEntry) error {
+	if err := os.Rename(path+".open", path); err != nil {
+		return err
+	}
+	m.ClosedAt = time.Now().UTC()
+	m.Location = path
+
+	if archiveS3.enabled() {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.dir, path)
+		loc, err := s3Put(ctx, archiveS3, filepath.ToSlash(rel), body)
+		if err != nil {
+			// Keep the local file; it is listed with its local path and
+			// can be uploaded by hand.
+			log.Printf("  [archive] upload %s: %v", rel, err)
+		} else {
+			m.Location = loc
+			os.Remove(path)
+		}
+	}
+	log.Printf("  [archive] closed %s (%d rows, LSN %d..%d)", m.Location, m.Rows, m.MinLSN, m.MaxLSN)
+	return s.appendManifest(ctx, m)
+}
+
+// appendManifest adds one line to manifest.ndjson (and mirrors the entry to
+// S3 as _manifest/<file>.json when configured).
+func (s *archiveSink) appendManifest(ctx context.Context, m archiveManifestEntry) error {
+	b, _ := json.Marshal(m)
+	f, err := os.OpenFile(filepath.Join(s.dir, "manifest.ndjson"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if archiveS3.enabled() {
+		name := fmt.Sprintf("_manifest/%s-%s-%s-%d.json", m.Table, m.Date, m.Topic, m.FirstOffset)
+		if _, err := s3Put(ctx, archiveS3, name, b); err != nil {
+			log.Printf("  [archive] upload manifest %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// roller closes files that have been open longer than archiveRollAfter.
+func (s *archiveSink) roller() {
+	defer close(s.done)
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			for key, af := range s.open {
+				if time.Since(af.entry.OpenedAt) >= archiveRollAfter {
+					if err := s.roll(context.Background(), key); err != nil {
+						log.Printf("  [archive] roll %s: %v", key, err)
+					}
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Flush writes buffered rows of every NDJSON file and fsyncs them. Parquet
+// rows stay buffered until their row group is full or the file rolls, so
+// files are not split into a tiny row group per batch.
+func (s *archiveSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, af := range s.open {
+		if af.pw != nil {
+			continue
+		}
+		if err := af.buf.Flush(); err != nil {
+			return err
+		}
+		if err := af.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint records how far the topic is safely archived in
+// archiveDir/_checkpoints/<topic>.json: pos itself, or for Parquet the
+// checkpoint from before the topic's oldest open file (see durable).
+func (s *archiveSink) Checkpoint(ctx context.Context, pos position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied[pos.Topic] = pos
+	if pos, ok := s.durable(pos.Topic); ok {
+		return s.writeCheckpoint(pos)
+	}
+	return nil
+}
+
+// durable returns the position up to which a topic's events are in files
+// that survive a crash. Open Parquet files do not: for them it is the
+// checkpoint from before the oldest one was opened, and false when there was
+// none. The caller holds s.mu.
+func (s *archiveSink) durable(topic string) (position, bool) {
+	pos, ok := s.applied[topic]
+	for _, af := range s.open {
+		if af.pw == nil || af.entry.Topic != topic {
+			continue
+		}
+		if !af.hasBefore {
+			return position{}, false
+		}
+		if af.before.Offset < pos.Offset {
+			pos = af.before
+		}
+	}
+	return pos, ok
+}
+
+// lag reports the position a topic is durably archived up to while it is
+// behind the last Checkpoint; the pgoutput stream confirms its slot no
+// further. An unknown position is returned as the zero position.
+func (s *archiveSink) lag(topic string) (position, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	applied, ok := s.applied[topic]
+	if !ok {
+		return position{}, false
+	}
+	pos, ok := s.durable(topic)
+	if !ok {
+		return position{}, true
+	}
+	return pos, pos.Offset < applied.Offset
+}
+
+// writeCheckpoint replaces the topic's checkpoint file atomically.
+func (s *archiveSink) writeCheckpoint(pos position) error {
+	dir := filepath.Join(s.dir, "_checkpoints")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(pos)
+	tmp := filepath.Join(dir, pos.Topic+".json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, pos.Topic+".json"))
+}
+
+// archiveCheckpoints reads the checkpoint files Checkpoint writes under dir.
+func archiveCheckpoints(dir string) checkpointReader {
+	return func(ctx context.Context, topic string) (position, bool, error) {
+		var pos position
+		b, err := os.ReadFile(filepath.Join(dir, "_checkpoints", topic+".json"))
+		if os.IsNotExist(err) {
+			return pos, false, nil
+		}
+		if err != nil {
+			return pos, false, err
+		}
+		if err := json.Unmarshal(b, &pos); err != nil {
+			return pos, false, err
+		}
+		return pos, true, nil
+	}
+}
+
+// Close stops the roller and closes every open file.
+func (s *archiveSink) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for key := range s.open {
+		if err := s.roll(context.Background(), key); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
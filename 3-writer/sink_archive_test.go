@@ -0,0 +1,115 @@
+// sink_archive_test.go — Tests for archive crash recovery and checkpoints.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveAdoptsOpenFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		content  string
+		wantRows int // rows in the manifest; -1 when no file is kept
+	}{
+		{"complete rows", "ndjson",
+			`{"table":"devices","kafka_topic":"t","kafka_offset":1,"lsn":10}` + "\n" +
+				`{"table":"devices","kafka_topic":"t","kafka_offset":2,"lsn":20}` + "\n", 2},
+		{"torn last row", "ndjson",
+			`{"table":"devices","kafka_topic":"t","kafka_offset":1,"lsn":10}` + "\n" + `{"table":"dev`, 1},
+		{"empty", "ndjson", "", -1},
+		{"parquet without footer", "parquet", "PAR1", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			part := filepath.Join(dir, "devices", "date=2024-01-02")
+			if err := os.MkdirAll(part, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			final := filepath.Join(part, "part-20240102T030405-t-1."+tt.format)
+			if err := os.WriteFile(final+".open", []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := newArchiveSink(dir, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, err := os.Stat(final + ".open"); !os.IsNotExist(err) {
+				t.Errorf(".open file left behind")
+			}
+			manifest, _ := os.ReadFile(filepath.Join(dir, "manifest.ndjson"))
+			if tt.wantRows < 0 {
+				if len(manifest) > 0 {
+					t.Errorf("manifest = %s, want empty", manifest)
+				}
+				return
+			}
+			if _, err := os.Stat(final); err != nil {
+				t.Errorf("file not closed: %v", err)
+			}
+			want := fmt.Sprintf(`"rows":%d`, tt.wantRows)
+			if !strings.Contains(string(manifest), want) || !strings.Contains(string(manifest), `"topic":"t"`) {
+				t.Errorf("manifest = %s, want %s for topic t", manifest, want)
+			}
+		})
+	}
+}
+
+func TestArchiveParquetCheckpointWaitsForClose(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := newArchiveSink(dir, "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := archiveCheckpoints(dir)
+	apply := func(off int64) {
+		e := changeEvent{Table: "devices", Op: "c", Topic: "t", Offset: off, LSN: off * 10, TsMs: 1704164645000,
+			After: map[string]interface{}{"id": float64(off)}}
+		if err := s.Apply(ctx, []changeEvent{e}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Checkpoint(ctx, position{Topic: "t", Offset: off, LSN: off * 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apply(1)
+	if _, ok, _ := read(ctx, "t"); ok {
+		t.Fatal("checkpoint written while the only file is open")
+	}
+	if _, behind := s.lag("t"); !behind {
+		t.Error("lag not reported for an open parquet file")
+	}
+	s.mu.Lock()
+	for key := range s.open {
+		if err := s.roll(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Unlock()
+	if pos, ok, _ := read(ctx, "t"); !ok || pos.Offset != 1 {
+		t.Fatalf("checkpoint after roll = %v, %v; want offset 1", pos, ok)
+	}
+
+	apply(2)
+	if pos, _, _ := read(ctx, "t"); pos.Offset != 1 {
+		t.Errorf("checkpoint moved into the open file: offset %d", pos.Offset)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _, _ := read(ctx, "t"); pos.Offset != 2 {
+		t.Errorf("checkpoint after close = %d, want 2", pos.Offset)
+	}
+}
@@ -0,0 +1,205 @@
+// sink_kafka.go — Kafka-to-Kafka republishing sink (outbox / fan-out).
+// Derives curated topics such as federation.device.health from the raw
+// ome.public.* change streams: events are selected per rule, re-keyed,
+// projected and produced synchronously with acks=all. Because Apply only
+// returns once the broker acknowledged every message, the consumer never
+// checkpoints a source offset before its republished events are durable.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// republishRule maps one source table to one curated topic.
+type republishRule struct {
+	Table  string            // source table
+	Topic  string            // target topic
+	Ops    []string          // ops to republish; empty = all
+	Key    []string          // columns forming the new message key; empty = the catalog key
+	Fields []string          // columns to keep; empty = all
+	Rename map[string]string // source column → output field name
+}
+
+// republishMessage is the value written to curated topics.
+type republishMessage struct {
+	Op     string                 `json:"op"`
+	Table  string                 `json:"table"`
+	Key    map[string]interface{} `json:"key"`
+	Data   map[string]interface{} `json:"data"` // after image, or before image for deletes
+	Source republishSource        `json:"source"`
+}
+
+type republishSource struct {
+	LSN    int64  `json:"lsn"`
+	TxID   int64  `json:"tx_id"`
+	TsMs   int64  `json:"ts_ms"`
+	Topic  string `json:"topic"`
+	Offset int64  `json:"offset"`
+}
+
+// kafkaSink republishes transformed events to other Kafka topics.
+type kafkaSink struct {
+	rules []republishRule
+	w     *kafka.Writer
+}
+
+// newKafkaSink creates a synchronous producer for the republish rules.
+//
+// kafka-go has no idempotent-producer mode, so the closest settings are used:
+// acks from all in-sync replicas, hash partitioning by the new key (per-key
+// order), synchronous writes, and cdc-* headers carrying the source position
+// so downstream consumers can drop duplicates produced by a retried batch.
+// Rules without a Key are keyed by the table's primary key from the catalog;
+// a table without one needs an explicit Key.
+func newKafkaSink(rules []republishRule) (*kafkaSink, error) {
+	rules = append([]republishRule(nil), rules...)
+	for i, r := range rules {
+		if r.Table == "" || r.Topic == "" {
+			return nil, fmt.Errorf("republish rule needs Table and Topic: %+v", r)
+		}
+		if len(r.Key) > 0 {
+			continue
+		}
+		key, err := catalogKey(r.Table)
+		if err != nil {
+			return nil, fmt.Errorf("republish %s: primary key: %w", r.Table, err)
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("republish %s: table has no primary key, set the rule's Key", r.Table)
+		}
+		rules[i].Key = republishKey(r.Table, key)
+	}
+	w := &kafka.Writer{
+		Addr:                   kafka.TCP(kafkaBroker),
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		MaxAttempts:            10,
+		BatchSize:              batchSize,
+		BatchTimeout:           10 * time.Millisecond,
+		AllowAutoTopicCreation: true,
+	}
+	log.Printf("  [republish] curated topics: %s", republishTopics(rules))
+	return &kafkaSink{rules: rules, w: w}, nil
+}
+
+// Apply transforms the batch through every matching rule and produces the
+// result in one WriteMessages call, returning once all messages are acked.
+func (s *kafkaSink) Apply(ctx context.Context, batch []changeEvent) error {
+	var msgs []kafka.Message
+	var dead deadLetters
+	for _, e := range batch {
+		for _, r := range s.rules {
+			if r.Table != e.Table || e.Op == "t" || (len(r.Ops) > 0 && !contains(r.Ops, e.Op)) {
+				continue
+			}
+			m, err := republish(r, e)
+			if err != nil {
+				dead.add("kafka:"+r.Topic, e, err)
+				continue
+			}
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) > 0 {
+		if err := s.w.WriteMessages(ctx, msgs...); err != nil {
+			return err
+		}
+	}
+	dead.record(ctx)
+	return nil
+}
+
+// republish builds the curated message for one event under one rule.
+func republish(r republishRule, e changeEvent) (kafka.Message, error) {
+	row := e.row()
+	if row == nil {
+		return kafka.Message{}, fmt.Errorf("no row image for op %q", e.Op)
+	}
+	out := republishMessage{Op: e.Op, Table: e.Table,
+		Key: make(map[string]interface{}), Data: make(map[string]interface{}),
+		Source: republishSource{LSN: e.LSN, TxID: e.TxID, TsMs: e.TsMs, Topic: e.Topic, Offset: e.Offset}}
+	for _, k := range r.Key {
+		v, ok := row[k]
+		if !ok {
+			return kafka.Message{}, fmt.Errorf("key column %q missing", k)
+		}
+		out.Key[fieldName(r, k)] = v
+	}
+	for k, v := range row {
+		if len(r.Fields) > 0 && !contains(r.Fields, k) {
+			continue
+		}
+		out.Data[fieldName(r, k)] = v
+	}
+
+	key, err := json.Marshal(out.Key)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	value, err := json.Marshal(out)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Topic: r.Topic,
+		Key:   key,
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "cdc-source-topic", Value: []byte(e.Topic)},
+			{Key: "cdc-source-offset", Value: []byte(strconv.FormatInt(e.Offset, 10))},
+			{Key: "cdc-lsn", Value: []byte(strconv.FormatInt(e.LSN, 10))},
+			{Key: "cdc-op", Value: []byte(e.Op)},
+		},
+	}, nil
+}
+
+// republishKey renames a table's catalog key to target columns, led by the
+// site column with several sources, as mapEvent keys the row images.
+func republishKey(table string, key []string) []string {
+	cfg := configFor(table)
+	var out []string
+	if multiSource() {
+		out = append(out, siteColumn)
+	}
+	for _, k := range key {
+		out = append(out, targetColumn(cfg, k))
+	}
+	return out
+}
+
+// fieldName applies the rule's rename map to a source column.
+func fieldName(r republishRule, col string) string {
+	if n, ok := r.Rename[col]; ok {
+		return n
+	}
+	return col
+}
+
+// Flush is a no-op: WriteMessages is synchronous.
+func (s *kafkaSink) Flush(ctx context.Context) error { return nil }
+
+// Checkpoint is a no-op: the source offset is recorded by the stateful sinks
+// once this sink's Apply has returned, i.e. after the republish was acked.
+func (s *kafkaSink) Checkpoint(ctx context.Context, pos position) error { return nil }
+
+// Close flushes and closes the producer.
+func (s *kafkaSink) Close() error { return s.w.Close() }
+
+// republishTopics lists the distinct target topics, for logging.
+func republishTopics(rules []republishRule) string {
+	var t []string
+	for _, r := range rules {
+		if !contains(t, r.Topic) {
+			t = append(t, r.Topic)
+		}
+	}
+	return strings.Join(t, ",")
+}
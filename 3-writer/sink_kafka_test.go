@@ -0,0 +1,93 @@
+// sink_kafka_test.go — Tests for the republish transform and its default key.
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRepublish(t *testing.T) {
+	device := map[string]interface{}{"id": float64(1000000), "service_tag": "ABC123", "model": "R750", "notes": "x"}
+	rule := republishRule{Table: "devices", Topic: "federation.device.health", Key: []string{"service_tag"},
+		Fields: []string{"id", "service_tag", "model"}, Rename: map[string]string{"id": "device_id"}}
+
+	tests := []struct {
+		name     string
+		rule     republishRule
+		e        changeEvent
+		wantKey  string
+		wantData map[string]interface{}
+		wantErr  bool
+	}{
+		{"projected and renamed", rule, changeEvent{Table: "devices", Op: "u", After: device},
+			`{"service_tag":"ABC123"}`,
+			map[string]interface{}{"device_id": float64(1000000), "service_tag": "ABC123", "model": "R750"}, false},
+		{"delete uses the before image", rule, changeEvent{Table: "devices", Op: "d", Before: device},
+			`{"service_tag":"ABC123"}`,
+			map[string]interface{}{"device_id": float64(1000000), "service_tag": "ABC123", "model": "R750"}, false},
+		{"renamed key field", republishRule{Table: "devices", Topic: "t", Key: []string{"id"}, Rename: map[string]string{"id": "device_id"}},
+			changeEvent{Table: "devices", Op: "c", After: map[string]interface{}{"id": float64(7)}},
+			`{"device_id":7}`, map[string]interface{}{"device_id": float64(7)}, false},
+		{"composite key", republishRule{Table: "devices", Topic: "t", Key: []string{siteColumn, "id"}},
+			changeEvent{Table: "devices", Op: "c", After: map[string]interface{}{siteColumn: "site2", "id": float64(7)}},
+			`{"id":7,"` + siteColumn + `":"site2"}`, // encoding/json sorts map keys
+			map[string]interface{}{siteColumn: "site2", "id": float64(7)}, false},
+		{"key column missing", rule, changeEvent{Table: "devices", Op: "u", After: map[string]interface{}{"id": float64(7)}},
+			"", nil, true},
+		{"no row image", rule, changeEvent{Table: "devices", Op: "d"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.e.Topic, tt.e.Offset, tt.e.LSN = "ome.public.devices", 42, 900
+			m, err := republish(tt.rule, tt.e)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(m.Key) != tt.wantKey || m.Topic != tt.rule.Topic {
+				t.Errorf("message %s key %s, want %s key %s", m.Topic, m.Key, tt.rule.Topic, tt.wantKey)
+			}
+			var out republishMessage
+			if err := json.Unmarshal(m.Value, &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Data, tt.wantData) || out.Op != tt.e.Op {
+				t.Errorf("value = %+v, want op %s data %v", out, tt.e.Op, tt.wantData)
+			}
+			headers := make(map[string]string)
+			for _, h := range m.Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			want := map[string]string{"cdc-source-topic": "ome.public.devices", "cdc-source-offset": "42", "cdc-lsn": "900", "cdc-op": tt.e.Op}
+			if !reflect.DeepEqual(headers, want) {
+				t.Errorf("headers = %v, want %v", headers, want)
+			}
+		})
+	}
+}
+
+func TestRepublishKey(t *testing.T) {
+	withTableConfig(t, "republish_t", tableConfig{Rename: map[string]string{"id": "device_id"}})
+	oldSources := sources
+	t.Cleanup(func() { sources = oldSources })
+
+	tests := []struct {
+		name    string
+		sources []source
+		key     []string
+		want    []string
+	}{
+		{"single source", sources[:1], []string{"id"}, []string{"device_id"}},
+		{"composite", sources[:1], []string{"tenant", "id"}, []string{"tenant", "device_id"}},
+		{"several sources", []source{sources[0], {Site: "site2"}}, []string{"id"}, []string{siteColumn, "device_id"}},
+	}
+	for _, tt := range tests {
+		sources = tt.sources
+		if got := republishKey("republish_t", tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: republishKey = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
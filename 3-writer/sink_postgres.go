@@ -0,0 +1,594 @@
+// sink_postgres.go — PostgreSQL sink (postgres2), the reference Sink.
+// Applies each batch in one transaction with a savepoint per row, using
+// INSERT ... ON CONFLICT for creates/updates and DELETE for deletes (or an
+// UPDATE marking the row deleted for tables in soft-delete mode).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresSink writes change events into a PostgreSQL database.
+type postgresSink struct {
+	db *sql.DB
+
+	tsCache   map[string]map[string]bool // schema.table → timestamp columns
+	tsCacheMu sync.Mutex
+
+	ensured   map[string]bool // source tables whose target has been prepared
+	ensuredMu sync.Mutex
+
+	fk       fkWaiter
+	commitTs bool // commit timestamps available for conflict resolution
+
+	cpOnce sync.Once
+	cpErr  error
+
+	stop, done chan struct{} // tombstone pruning (keystate.go)
+}
+
+// newPostgresSink opens a connection pool to the given DSN and prepares the
+// LSN guard, origin, soft-delete, metadata and history tables. Mapped target
+// tables that do not exist are created from the source catalog (catalogFor).
+func newPostgresSink(dsn string) (*postgresSink, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &postgresSink{db: db,
+		tsCache: make(map[string]map[string]bool), ensured: make(map[string]bool)}
+	if lsnGuard {
+		for _, q := range []string{keyStateDDL, bootstrapDDL, checkpointsDDL} {
+			if _, err := db.Exec(q); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.pruneLoop()
+	}
+	if failbackEnabled {
+		for _, q := range []string{originDDL, conflictsDDL} {
+			if _, err := db.Exec(q); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		s.commitTs = commitTimestamps(db)
+	}
+	// Add writer-managed columns and history tables up front so restored rows
+	// are covered before the table's first change arrives.
+	for _, t := range tables {
+		if cfg := configFor(t); cfg.SoftDelete || cfg.History || cfg.Metadata {
+			if err := s.ensureTarget(context.Background(), mapEvent(changeEvent{Table: t})); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Apply writes the batch in a single transaction. A row that fails is rolled
+// back to its savepoint and dead-lettered in the same transaction; the rest
+// of the batch still commits.
+// A foreign-key violation instead fails the whole batch so the consumer
+// retries it once the other table's consumer has written the referenced row;
+// only after fkRetryTimeout is the row dead-lettered. Apply times feed the
+// adaptive backpressure (see throttle.go).
+func (s *postgresSink) Apply(ctx context.Context, batch []changeEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := s.apply(ctx, batch)
+	throttle.observe(batch[0].Table, time.Since(start), err)
+	return err
+}
+
+// apply writes one non-empty batch; see Apply.
+func (s *postgresSink) apply(ctx context.Context, batch []changeEvent) error {
+	if err := s.ensureTarget(ctx, batch[0]); err != nil {
+		return err
+	}
+	if _, err := openDeadLetters(ctx); err != nil {
+		return fmt.Errorf("dead letters: %w", err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if failbackEnabled {
+		// Marks the batch as the writer's so failback does not echo it.
+		if err := tagOrigin(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range batch {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT cdc_row"); err != nil {
+			return err
+		}
+		if err := s.applyEvent(ctx, tx, e); err != nil {
+			if isFKViolation(err) && s.fk.await(batch) {
+				return fmt.Errorf("%s %v: %w: %w", opName(e.Op), keyValues(e.Key, e.row()), errFKWait, err)
+			}
+			cause := fmt.Errorf("%s: %w", opName(e.Op), err)
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT cdc_row"); err != nil {
+				return err
+			}
+			if err := insertDeadLetter(ctx, tx, "postgres2", e, cause); err != nil {
+				return fmt.Errorf("dead letter: %w", err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT cdc_row"); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.fk.clear(batch)
+	return nil
+}
+
+// applyEvent passes a single event through the LSN guard and, with failback,
+// conflict resolution, dispatches it to upsert or del, then records the
+// change in the history table when the table keeps one.
+func (s *postgresSink) applyEvent(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	if e.Op == "t" {
+		return s.truncate(ctx, tx, e)
+	}
+	if (e.Op == "d" && e.Before == nil) || (e.Op != "d" && e.After == nil) {
+		return nil
+	}
+	var err error
+	if lsnGuard {
+		err = s.guardKey(ctx, tx, e)
+	}
+	if err == nil && conflictChecked(e) {
+		var apply bool
+		if e, apply, err = resolveConflict(ctx, tx, e, s.commitTs); err == nil && !apply {
+			return nil
+		}
+	}
+	if err == nil {
+		if e.Op == "d" {
+			err = s.del(ctx, tx, e)
+		} else {
+			err = s.upsert(ctx, tx, e)
+		}
+	}
+	if err == errStale {
+		log.Printf("  [writer] skipped stale %s id=%v lsn=%d", e.Target, keyValues(e.Key, e.row()), e.LSN)
+		return nil
+	}
+	if err == nil && configFor(e.Table).History {
+		err = s.recordHistory(ctx, tx, e)
+	}
+	return err
+}
+
+// ensureTarget prepares the target table of an event's source table on first
+// use: creates it when mapped (normally seedMappedTables already did during
+// bootstrap), adds the soft-delete and metadata columns and creates the
+// history table when the table needs them.
+func (s *postgresSink) ensureTarget(ctx context.Context, e changeEvent) error {
+	table := e.Table
+	cfg := configFor(table)
+	if !isMapped(table) && !cfg.SoftDelete && !cfg.History && !cfg.Metadata {
+		return nil
+	}
+	s.ensuredMu.Lock()
+	defer s.ensuredMu.Unlock()
+	if s.ensured[table] {
+		return nil
+	}
+	if isMapped(table) {
+		cat, err := catalogFor(table)
+		if err != nil {
+			return err
+		}
+		ts, err := targetTableSchema(ctx, cat, table)
+		if err != nil {
+			return err
+		}
+		if err := createPostgresTable(ctx, s.db, e.Schema, ts); err != nil {
+			return err
+		}
+	}
+	var defs []string
+	if cfg.SoftDelete {
+		defs = append(defs, softDeleteColumns...)
+	}
+	if cfg.Metadata {
+		defs = append(defs, metadataColumns...)
+	}
+	for _, def := range defs {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
+			qualifiedTarget(e), def)); err != nil {
+			return err
+		}
+	}
+	if cfg.History {
+		if err := s.ensureHistory(ctx, e); err != nil {
+			return err
+		}
+	}
+	s.ensured[table] = true
+	return nil
+}
+
+// Flush is a no-op: every Apply commits before returning.
+func (s *postgresSink) Flush(ctx context.Context) error { return nil }
+
+// checkpointsDDL creates the table PostgreSQL sinks record positions in.
+const checkpointsDDL = `CREATE TABLE IF NOT EXISTS _cdc_checkpoints (
+	topic TEXT PRIMARY KEY, kafka_offset BIGINT NOT NULL,
+	lsn BIGINT NOT NULL, updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW())`
+
+// Checkpoint upserts the position into the _cdc_checkpoints table,
+// creating it on first use.
+func (s *postgresSink) Checkpoint(ctx context.Context, pos position) error {
+	s.cpOnce.Do(func() {
+		_, s.cpErr = s.db.ExecContext(ctx, checkpointsDDL)
+	})
+	if s.cpErr != nil {
+		return s.cpErr
+	}
+	return saveCheckpoint(ctx, s.db, pos)
+}
+
+// saveCheckpoint upserts a position into _cdc_checkpoints.
+func saveCheckpoint(ctx context.Context, db *sql.DB, pos position) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO _cdc_checkpoints (topic,kafka_offset,lsn) VALUES ($1,$2,$3)
+		ON CONFLICT (topic) DO UPDATE SET kafka_offset=EXCLUDED.kafka_offset, lsn=EXCLUDED.lsn, updated_at=NOW()`,
+		pos.Topic, pos.Offset, pos.LSN)
+	return err
+}
+
+// pgCheckpoints reads the checkpoints saveCheckpoint keeps in the database
+// at dsn. A missing _cdc_checkpoints table means none were recorded yet.
+func pgCheckpoints(dsn string) checkpointReader {
+	return func(ctx context.Context, topic string) (position, bool, error) {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return position{}, false, err
+		}
+		defer db.Close()
+		pos := position{Topic: topic}
+		err = db.QueryRowContext(ctx, "SELECT kafka_offset, lsn FROM _cdc_checkpoints WHERE topic=$1", topic).Scan(&pos.Offset, &pos.LSN)
+		var pqErr *pq.Error
+		if err == sql.ErrNoRows || errors.As(err, &pqErr) && pqErr.Code == "42P01" {
+			return pos, false, nil
+		}
+		return pos, err == nil, err
+	}
+}
+
+// Close stops tombstone pruning and closes the connection pool.
+func (s *postgresSink) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	return s.db.Close()
+}
+
+// opName returns a log-friendly verb for a Debezium op code.
+func opName(op string) string {
+	switch op {
+	case "d":
+		return "delete"
+	case "t":
+		return "truncate"
+	}
+	return "upsert"
+}
+
+// ═══════════════════════════════════════════════════════════════
+// TIMESTAMP AUTO-DETECTION FROM SCHEMA
+// ═══════════════════════════════════════════════════════════════
+
+// timestampColumns returns a set of column names that are timestamp/date
+// types for the given target table. Results are cached after first lookup so
+// we only query information_schema once per table.
+func (s *postgresSink) timestampColumns(ctx context.Context, schema, table string) map[string]bool {
+	s.tsCacheMu.Lock()
+	defer s.tsCacheMu.Unlock()
+
+	key := schema + "." + table
+	if cols, ok := s.tsCache[key]; ok {
+		return cols
+	}
+
+	cols := make(map[string]bool)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema=$1 AND table_name=$2
+		  AND data_type IN ('timestamp without time zone','timestamp with time zone','date')`, schema, table)
+	if err != nil {
+		s.tsCache[key] = cols
+		return cols
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		cols[name] = true
+	}
+	s.tsCache[key] = cols
+	return cols
+}
+
+// convertTimestamp converts Debezium epoch-encoded temporal values to Go time.Time.
+//
+// Debezium 3.4 with time.precision.mode=isostring sends timestamps as
+// ISO-8601 strings (e.g. "2026-02-16T21:04:46.955Z") which PostgreSQL accepts
+// natively. This function handles the fallback case where the value is still
+// numeric (e.g. if isostring mode was not applied for some fields).
+func convertTimestamp(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	switch n := v.(type) {
+	case float64:
+		epoch := int64(n)
+		if epoch == 0 {
+			return v
+		}
+		// Try as microseconds first: if year < 2000, it's actually milliseconds
+		asUsec := time.Unix(epoch/1_000_000, (epoch%1_000_000)*1000)
+		if asUsec.Year() >= 2000 && asUsec.Year() <= 2100 {
+			return asUsec // It's microseconds
+		}
+		// Otherwise treat as milliseconds
+		return time.Unix(epoch/1_000, (epoch%1_000)*1_000_000)
+	default:
+		return v // strings (ISO-8601) pass through — PG accepts them natively
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════
+// UPSERT + DELETE
+// ═══════════════════════════════════════════════════════════════
+
+// upsert builds and executes an INSERT ... ON CONFLICT(key) DO UPDATE
+// statement for the event's target table and after image, auto-detecting
+// timestamp columns from the schema and converting Debezium epoch values to
+// time.Time. Computed columns are written as their SQL expressions.
+func (s *postgresSink) upsert(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	data := e.After
+	tsCols := s.timestampColumns(ctx, e.Schema, e.Target)
+
+	var cols, phs, ups []string
+	var vals []interface{}
+	for k, v := range data {
+		vals = append(vals, v)
+		// Auto-convert timestamp columns detected from schema
+		if tsCols[k] {
+			vals[len(vals)-1] = convertTimestamp(v)
+		}
+		cols = append(cols, quoteIdent(k))
+		phs = append(phs, fmt.Sprintf("$%d", len(vals)))
+		if expr, ok := e.Merge[k]; ok {
+			ups = append(ups, fmt.Sprintf("%s=%s", quoteIdent(k), expr))
+		} else if !contains(e.Key, k) {
+			ups = append(ups, fmt.Sprintf("%s=$%d", quoteIdent(k), len(vals)))
+		}
+	}
+	cfg := configFor(e.Table)
+	for k, c := range cfg.Computed {
+		cols = append(cols, quoteIdent(k))
+		phs = append(phs, c.Expr)
+		ups = append(ups, fmt.Sprintf("%s=%s", quoteIdent(k), c.Expr))
+	}
+	if cfg.SoftDelete {
+		// A (re-)insert or update of the key brings a soft-deleted row back.
+		cols = append(cols, "_deleted", "_deleted_at", "_deleted_source_ts")
+		phs = append(phs, "false", "NULL", "NULL")
+		ups = append(ups, "_deleted=false", "_deleted_at=NULL", "_deleted_source_ts=NULL")
+	}
+	if cfg.Metadata {
+		names, mvals := metadataValues(e)
+		for i, k := range names {
+			vals = append(vals, mvals[i])
+			cols = append(cols, k)
+			phs = append(phs, fmt.Sprintf("$%d", len(vals)))
+			ups = append(ups, fmt.Sprintf("%s=$%d", k, len(vals)))
+		}
+		cols = append(cols, "_cdc_applied_at")
+		phs = append(phs, "NOW()")
+		ups = append(ups, "_cdc_applied_at=NOW()")
+	}
+	if len(ups) == 0 {
+		return nil
+	}
+	q := fmt.Sprintf(`INSERT INTO %s AS _t (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s`,
+		qualifiedTarget(e), strings.Join(cols, ","), strings.Join(phs, ","), quoteIdents(e.Key), strings.Join(ups, ","))
+	if cfg.SkipStale {
+		q += " WHERE _t._cdc_lsn IS NULL OR _t._cdc_lsn <= EXCLUDED._cdc_lsn"
+	}
+	res, err := tx.ExecContext(ctx, q, vals...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 && cfg.SkipStale {
+		return errStale
+	}
+	log.Printf("  [writer] synced %s id=%v", e.Target, keyValues(e.Key, data))
+	return nil
+}
+
+// del issues a DELETE statement for the event's target table and key, or
+// marks the row deleted when the table is in soft-delete mode.
+func (s *postgresSink) del(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	if configFor(e.Table).SoftDelete {
+		return s.softDelete(ctx, tx, e)
+	}
+	where, vals := keyWhere(e.Key, e.Before, 1)
+	if configFor(e.Table).SkipStale {
+		vals = append(vals, e.LSN)
+		where += fmt.Sprintf(" AND (_cdc_lsn IS NULL OR _cdc_lsn <= $%d)", len(vals))
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", qualifiedTarget(e), where), vals...); err != nil {
+		return err
+	}
+	log.Printf("  [writer] deleted %s id=%v", e.Target, keyValues(e.Key, e.Before))
+	return nil
+}
+
+// truncate empties the event's target table. With several sources only the
+// rows of the event's site go; soft-delete tables have their rows marked
+// deleted instead. DELETE rather than TRUNCATE keeps it inside the batch's
+// savepoint and works on tables other tables still reference.
+func (s *postgresSink) truncate(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	var where []string
+	var vals []interface{}
+	if multiSource() {
+		vals = append(vals, e.Site)
+		where = append(where, fmt.Sprintf("%s=$%d", quoteIdent(siteColumn), len(vals)))
+	}
+	q := "DELETE FROM " + qualifiedTarget(e)
+	if configFor(e.Table).SoftDelete {
+		vals = append(vals, sourceTime(e.TsMs))
+		q = fmt.Sprintf("UPDATE %s SET _deleted=true, _deleted_at=NOW(), _deleted_source_ts=$%d", qualifiedTarget(e), len(vals))
+		where = append(where, "NOT _deleted")
+	}
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	res, err := tx.ExecContext(ctx, q, vals...)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	log.Printf("  [writer] truncated %s (%d rows)", e.Target, n)
+	if configFor(e.Table).History {
+		// Every open version of the table ends with the truncate.
+		q := fmt.Sprintf("UPDATE %s SET valid_to=COALESCE($1::timestamptz, NOW()) WHERE valid_to IS NULL", historyTable(e))
+		args := []interface{}{sourceTime(e.TsMs)}
+		if multiSource() {
+			q += fmt.Sprintf(" AND %s=$2", quoteIdent(siteColumn))
+			args = append(args, e.Site)
+		}
+		_, err = tx.ExecContext(ctx, q, args...)
+	}
+	return err
+}
+
+// ═══════════════════════════════════════════════════════════════
+// SOFT DELETE
+// ═══════════════════════════════════════════════════════════════
+
+// softDeleteColumns are added to the target of every soft-delete table.
+// _deleted_at is when the writer applied the delete, _deleted_source_ts the
+// delete's commit time on the source.
+var softDeleteColumns = []string{
+	"_deleted BOOLEAN NOT NULL DEFAULT false",
+	"_deleted_at TIMESTAMPTZ",
+	"_deleted_source_ts TIMESTAMPTZ",
+}
+
+// softDelete marks the event's row deleted instead of removing it. Rows that
+// are already marked keep their original deletion times.
+func (s *postgresSink) softDelete(ctx context.Context, tx *sql.Tx, e changeEvent) error {
+	cfg := configFor(e.Table)
+	where, vals := keyWhere(e.Key, e.Before, 2)
+	vals = append([]interface{}{sourceTime(e.TsMs)}, vals...)
+	sets := "_deleted=true, _deleted_at=NOW(), _deleted_source_ts=$1"
+	if cfg.Metadata {
+		names, mvals := metadataValues(e)
+		for i, k := range names {
+			vals = append(vals, mvals[i])
+			sets += fmt.Sprintf(", %s=$%d", k, len(vals))
+		}
+		sets += ", _cdc_applied_at=NOW()"
+	}
+	if cfg.SkipStale {
+		vals = append(vals, e.LSN)
+		where += fmt.Sprintf(" AND (_cdc_lsn IS NULL OR _cdc_lsn <= $%d)", len(vals))
+	}
+	q := fmt.Sprintf(`UPDATE %s SET %s WHERE %s AND NOT _deleted`, qualifiedTarget(e), sets, where)
+	if _, err := tx.ExecContext(ctx, q, vals...); err != nil {
+		return err
+	}
+	log.Printf("  [writer] soft-deleted %s id=%v", e.Target, keyValues(e.Key, e.Before))
+	return nil
+}
+
+// sourceTime converts a source commit time in epoch milliseconds, NULL when
+// unknown.
+func sourceTime(tsMs int64) interface{} {
+	if tsMs == 0 {
+		return nil
+	}
+	return time.UnixMilli(tsMs).UTC()
+}
+
+// ═══════════════════════════════════════════════════════════════
+// CHANGE METADATA
+// ═══════════════════════════════════════════════════════════════
+
+// metadataColumns are added to the target of every table with Metadata:
+// where the row's last applied change came from and when it was applied.
+var metadataColumns = []string{
+	"_cdc_lsn BIGINT",
+	"_cdc_tx_id BIGINT",
+	"_cdc_source_ts TIMESTAMPTZ",
+	"_cdc_applied_at TIMESTAMPTZ",
+	"_cdc_op CHAR(1)",
+}
+
+// errStale reports a change skipped because the row or key already holds a
+// change with a newer LSN (SkipStale, lsnGuard).
+var errStale = errors.New("stale event")
+
+// errFKWait marks a batch retried until a referenced row arrives (see Apply).
+var errFKWait = errors.New("waiting for referenced row")
+
+// metadataValues returns the source-derived metadata columns and their
+// values for an event; _cdc_applied_at is set by the database.
+func metadataValues(e changeEvent) ([]string, []interface{}) {
+	return []string{"_cdc_lsn", "_cdc_tx_id", "_cdc_source_ts", "_cdc_op"},
+		[]interface{}{e.LSN, e.TxID, sourceTime(e.TsMs), e.Op}
+}
+
+// keyWhere renders "k1=$n AND k2=$n+1 ..." for the key columns of a row,
+// numbering placeholders from first.
+func keyWhere(key []string, row map[string]interface{}, first int) (string, []interface{}) {
+	var parts []string
+	var vals []interface{}
+	for i, k := range key {
+		parts = append(parts, fmt.Sprintf("%s=$%d", quoteIdent(k), first+i))
+		vals = append(vals, row[k])
+	}
+	return strings.Join(parts, " AND "), vals
+}
+
+// keyValues renders a row's key for logging: the bare value for single-column
+// keys, a slice otherwise.
+func keyValues(key []string, row map[string]interface{}) interface{} {
+	if len(key) == 1 {
+		return row[key[0]]
+	}
+	vals := make([]interface{}, len(key))
+	for i, k := range key {
+		vals[i] = row[k]
+	}
+	return vals
+}
@@ -0,0 +1,274 @@
+// sink_sqlite.go — Embedded SQLite sink for edge nodes and tests.
+// Tables are created on first use from the source catalog (catalogFor), with
+// Postgres types mapped to SQLite affinities, and rows are upserted via
+// INSERT ... ON CONFLICT(pk) DO UPDATE. Mapped targets ("schema.table") become
+// a single table named "schema.table"; computed columns are not supported.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSink writes change events into a single SQLite database file.
+type sqliteSink struct {
+	db *sql.DB
+
+	schemas   map[string]tableSchema // tables created so far
+	schemasMu sync.Mutex
+}
+
+// newSQLiteSink opens (creating if needed) the SQLite file at path.
+func newSQLiteSink(path string) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialize through one connection.
+	db.SetMaxOpenConns(1)
+	for _, p := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", "PRAGMA synchronous=NORMAL"} {
+		if _, err := db.Exec(p); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS _cdc_checkpoints (
+		topic TEXT PRIMARY KEY, kafka_offset INTEGER NOT NULL,
+		lsn INTEGER NOT NULL, updated_at TEXT NOT NULL)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSink{db: db, schemas: make(map[string]tableSchema)}, nil
+}
+
+// Apply writes the batch in one transaction. Row failures are dead-lettered
+// and skipped, mirroring the postgres sink.
+func (s *sqliteSink) Apply(ctx context.Context, batch []changeEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	ts, err := s.ensureTable(ctx, batch[0].Table)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var dead deadLetters
+	for _, e := range batch {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT cdc_row"); err != nil {
+			return err
+		}
+		if err := s.applyEvent(ctx, tx, ts, e); err != nil {
+			dead.add("sqlite", e, fmt.Errorf("%s: %w", opName(e.Op), err))
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO cdc_row"); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE cdc_row"); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dead.record(ctx)
+	return nil
+}
+
+// applyEvent upserts or deletes one row, or empties the table on a truncate.
+func (s *sqliteSink) applyEvent(ctx context.Context, tx *sql.Tx, ts tableSchema, e changeEvent) error {
+	switch e.Op {
+	case "c", "r", "u":
+		if e.After == nil {
+			return nil
+		}
+		var cols, phs, ups []string
+		var vals []interface{}
+		for _, c := range ts.Columns {
+			v, ok := e.After[c.Name]
+			if !ok {
+				continue
+			}
+			cols = append(cols, quoteIdent(c.Name))
+			phs = append(phs, "?")
+			if !contains(ts.Key, c.Name) {
+				ups = append(ups, fmt.Sprintf("%s=excluded.%s", quoteIdent(c.Name), quoteIdent(c.Name)))
+			}
+			vals = append(vals, sqliteValue(c.Type, v))
+		}
+		q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO ",
+			quoteIdent(ts.Name), strings.Join(cols, ","), strings.Join(phs, ","), quoteIdents(ts.Key))
+		if len(ups) == 0 {
+			q += "NOTHING"
+		} else {
+			q += "UPDATE SET " + strings.Join(ups, ",")
+		}
+		_, err := tx.ExecContext(ctx, q, vals...)
+		return err
+	case "d":
+		if e.Before == nil {
+			return nil
+		}
+		var where []string
+		var vals []interface{}
+		for _, k := range ts.Key {
+			where = append(where, quoteIdent(k)+"=?")
+			vals = append(vals, e.Before[k])
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s",
+			quoteIdent(ts.Name), strings.Join(where, " AND ")), vals...)
+		return err
+	case "t":
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+quoteIdent(ts.Name))
+		return err
+	}
+	return nil
+}
+
+// ensureTable creates the SQLite table for a source table on first use.
+func (s *sqliteSink) ensureTable(ctx context.Context, table string) (tableSchema, error) {
+	s.schemasMu.Lock()
+	defer s.schemasMu.Unlock()
+	if ts, ok := s.schemas[table]; ok {
+		return ts, nil
+	}
+	cat, err := catalogFor(table)
+	if err != nil {
+		return tableSchema{}, err
+	}
+	ts, err := targetTableSchema(ctx, cat, table)
+	if err != nil {
+		return ts, err
+	}
+	if schema, _ := targetOf(table); schema != "public" {
+		ts.Name = schema + "." + ts.Name
+	}
+	computed := configFor(table).Computed
+	cols := ts.Columns[:0]
+	for _, c := range ts.Columns {
+		if _, ok := computed[c.Name]; !ok {
+			cols = append(cols, c)
+		}
+	}
+	ts.Columns = cols
+	if len(ts.Key) == 0 {
+		return ts, fmt.Errorf("table %s has no primary key", table)
+	}
+	return ts, s.createTable(ctx, table, ts)
+}
+
+// createTable creates the SQLite table ts for a source table and remembers
+// it; the caller holds schemasMu.
+func (s *sqliteSink) createTable(ctx context.Context, table string, ts tableSchema) error {
+	var defs []string
+	for _, c := range ts.Columns {
+		d := quoteIdent(c.Name) + " " + sqliteType(c.Type)
+		if c.NotNull {
+			d += " NOT NULL"
+		}
+		defs = append(defs, d)
+	}
+	defs = append(defs, "PRIMARY KEY ("+quoteIdents(ts.Key)+")")
+	if _, err := s.db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)",
+		quoteIdent(ts.Name), strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	s.schemas[table] = ts
+	log.Printf("  [sqlite] table %s ready (%d columns)", ts.Name, len(ts.Columns))
+	return nil
+}
+
+// Flush is a no-op: every Apply commits before returning.
+func (s *sqliteSink) Flush(ctx context.Context) error { return nil }
+
+// Checkpoint records the position in the _cdc_checkpoints table.
+func (s *sqliteSink) Checkpoint(ctx context.Context, pos position) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO _cdc_checkpoints (topic,kafka_offset,lsn,updated_at) VALUES (?,?,?,?)
+		ON CONFLICT (topic) DO UPDATE SET kafka_offset=excluded.kafka_offset, lsn=excluded.lsn, updated_at=excluded.updated_at`,
+		pos.Topic, pos.Offset, pos.LSN, time.Now().UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// sqliteCheckpoints reads the checkpoints of the SQLite file at path, read
+// only; a missing file or table means none were recorded yet.
+func sqliteCheckpoints(path string) checkpointReader {
+	return func(ctx context.Context, topic string) (position, bool, error) {
+		pos := position{Topic: topic}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return pos, false, nil
+		}
+		db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+		if err != nil {
+			return pos, false, err
+		}
+		defer db.Close()
+		err = db.QueryRowContext(ctx, "SELECT kafka_offset, lsn FROM _cdc_checkpoints WHERE topic=?", topic).Scan(&pos.Offset, &pos.LSN)
+		if err == sql.ErrNoRows || err != nil && strings.Contains(err.Error(), "no such table") {
+			return pos, false, nil
+		}
+		return pos, err == nil, err
+	}
+}
+
+// Close closes the SQLite file.
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
+
+// sqliteType maps a PostgreSQL format_type() name to an SQLite column type.
+// Temporal types are stored as ISO-8601 TEXT, JSON as TEXT, NUMERIC keeps
+// NUMERIC affinity so Debezium's decimal strings compare numerically.
+func sqliteType(pgType string) string {
+	t := strings.ToLower(pgType)
+	switch {
+	case strings.HasPrefix(t, "smallint"), strings.HasPrefix(t, "integer"),
+		strings.HasPrefix(t, "bigint"), t == "boolean":
+		return "INTEGER"
+	case strings.HasPrefix(t, "real"), strings.HasPrefix(t, "double precision"):
+		return "REAL"
+	case strings.HasPrefix(t, "numeric"), strings.HasPrefix(t, "decimal"):
+		return "NUMERIC"
+	case t == "bytea":
+		return "BLOB"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqliteValue converts a Debezium JSON value for storage in SQLite.
+func sqliteValue(pgType string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	t := strings.ToLower(pgType)
+	if strings.HasPrefix(t, "timestamp") || t == "date" {
+		if tm, ok := convertTimestamp(v).(time.Time); ok {
+			return tm.UTC().Format(time.RFC3339Nano)
+		}
+		return v
+	}
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+	return v
+}
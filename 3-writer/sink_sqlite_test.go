@@ -0,0 +1,186 @@
+// sink_sqlite_test.go — Tests for the SQLite sink's writes, checkpoints and type mapping.
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTestSQLite opens a sink on a temp-dir file with a devices table.
+func openTestSQLite(t *testing.T) (*sqliteSink, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "federation.db")
+	s, err := newSQLiteSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	ts := tableSchema{Name: "devices", Key: []string{"id"}, Columns: []column{
+		{Name: "id", Type: "integer", NotNull: true},
+		{Name: "name", Type: "character varying(20)"},
+		{Name: "active", Type: "boolean"},
+	}}
+	if err := s.createTable(context.Background(), "devices", ts); err != nil {
+		t.Fatal(err)
+	}
+	return s, path
+}
+
+// sqliteRows returns the devices table as id → name/active.
+func sqliteRows(t *testing.T, s *sqliteSink) map[int64]string {
+	t.Helper()
+	rows, err := s.db.Query(`SELECT id, COALESCE(name, ''), COALESCE(active, -1) FROM devices`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[int64]string)
+	for rows.Next() {
+		var id, active int64
+		var name string
+		if err := rows.Scan(&id, &name, &active); err != nil {
+			t.Fatal(err)
+		}
+		got[id] = name + "/" + map[int64]string{-1: "null", 0: "false", 1: "true"}[active]
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSQLiteSinkApply(t *testing.T) {
+	row := func(id float64, name string, active bool) map[string]interface{} {
+		return map[string]interface{}{"id": id, "name": name, "active": active}
+	}
+	ev := func(op string, before, after map[string]interface{}) changeEvent {
+		return changeEvent{Table: "devices", Op: op, Key: []string{"id"}, Before: before, After: after}
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]changeEvent
+		want    map[int64]string
+	}{
+		{"inserts", [][]changeEvent{{ev("c", nil, row(1, "r750", true)), ev("r", nil, row(2, "r650", false))}},
+			map[int64]string{1: "r750/true", 2: "r650/false"}},
+		{"update upserts", [][]changeEvent{{ev("c", nil, row(1, "r750", true))}, {ev("u", nil, row(1, "r760", false))}},
+			map[int64]string{1: "r760/false"}},
+		{"update of a missing row inserts", [][]changeEvent{{ev("u", nil, row(3, "r740", true))}},
+			map[int64]string{3: "r740/true"}},
+		{"unchanged toast column kept", [][]changeEvent{{ev("c", nil, row(1, "r750", true))},
+			{ev("u", nil, map[string]interface{}{"id": float64(1), "active": false})}},
+			map[int64]string{1: "r750/false"}},
+		{"key-only update does nothing", [][]changeEvent{{ev("c", nil, row(1, "r750", true))},
+			{ev("u", nil, map[string]interface{}{"id": float64(1)})}},
+			map[int64]string{1: "r750/true"}},
+		{"delete", [][]changeEvent{{ev("c", nil, row(1, "r750", true)), ev("c", nil, row(2, "r650", true))},
+			{ev("d", map[string]interface{}{"id": float64(1)}, nil)}},
+			map[int64]string{2: "r650/true"}},
+		{"delete without before image ignored", [][]changeEvent{{ev("c", nil, row(1, "r750", true))}, {ev("d", nil, nil)}},
+			map[int64]string{1: "r750/true"}},
+		{"truncate", [][]changeEvent{{ev("c", nil, row(1, "r750", true)), ev("c", nil, row(2, "r650", true))},
+			{ev("t", nil, nil), ev("c", nil, row(3, "r740", true))}},
+			map[int64]string{3: "r740/true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := openTestSQLite(t)
+			for _, batch := range tt.batches {
+				if err := s.Apply(context.Background(), batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := sqliteRows(t, s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLiteCheckpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s, path := openTestSQLite(t)
+	read := sqliteCheckpoints(path)
+	for _, pos := range []position{
+		{Topic: "site1.public.devices", Offset: 41, LSN: 1000},
+		{Topic: "site1.public.devices", Offset: 42, LSN: 1100},
+		{Topic: "site1.public.alerts", Offset: 7, LSN: 900},
+	} {
+		if err := s.Checkpoint(ctx, pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		read   checkpointReader
+		topic  string
+		want   position
+		wantOK bool
+	}{
+		{"latest wins", read, "site1.public.devices", position{Topic: "site1.public.devices", Offset: 42, LSN: 1100}, true},
+		{"other topic", read, "site1.public.alerts", position{Topic: "site1.public.alerts", Offset: 7, LSN: 900}, true},
+		{"unknown topic", read, "site1.public.sensors", position{Topic: "site1.public.sensors"}, false},
+		{"missing file", sqliteCheckpoints(filepath.Join(t.TempDir(), "none.db")), "site1.public.devices",
+			position{Topic: "site1.public.devices"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := tt.read(ctx, tt.topic)
+			if err != nil || ok != tt.wantOK || got != tt.want {
+				t.Errorf("checkpoint = %+v, %v, %v; want %+v, %v", got, ok, err, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSQLiteType(t *testing.T) {
+	tests := []struct{ pg, want string }{
+		{"integer", "INTEGER"},
+		{"bigint", "INTEGER"},
+		{"smallint", "INTEGER"},
+		{"boolean", "INTEGER"},
+		{"double precision", "REAL"},
+		{"real", "REAL"},
+		{"numeric(10,2)", "NUMERIC"},
+		{"bytea", "BLOB"},
+		{"timestamp with time zone", "TEXT"},
+		{"character varying(20)", "TEXT"},
+		{"jsonb", "TEXT"},
+	}
+	for _, tt := range tests {
+		if got := sqliteType(tt.pg); got != tt.want {
+			t.Errorf("sqliteType(%q) = %s, want %s", tt.pg, got, tt.want)
+		}
+	}
+}
+
+func TestSQLiteValue(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		pg   string
+		v    interface{}
+		want interface{}
+	}{
+		{"null", "integer", nil, nil},
+		{"true", "boolean", true, 1},
+		{"false", "boolean", false, 0},
+		{"number", "integer", float64(7), float64(7)},
+		{"micros timestamp", "timestamp with time zone", float64(at.UnixMicro()), "2026-01-02T03:04:05Z"},
+		{"millis timestamp", "timestamp without time zone", float64(at.UnixMilli()), "2026-01-02T03:04:05Z"},
+		{"text timestamp", "timestamp with time zone", "2026-01-02T03:04:05Z", "2026-01-02T03:04:05Z"},
+		{"json object", "jsonb", map[string]interface{}{"a": float64(1)}, `{"a":1}`},
+		{"json array", "jsonb", []interface{}{"x", float64(2)}, `["x",2]`},
+		{"decimal string", "numeric(10,2)", "12.50", "12.50"},
+	}
+	for _, tt := range tests {
+		if got := sqliteValue(tt.pg, tt.v); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sqliteValue = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// sink_test.go — Tests for the fanout sink and the sinks' checkpoint lookup.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// countingSink counts applied batches and fails while fails > 0.
+type countingSink struct {
+	applied int
+	fails   int
+}
+
+func (s *countingSink) Apply(ctx context.Context, batch []changeEvent) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("unavailable")
+	}
+	s.applied++
+	return nil
+}
+func (s *countingSink) Flush(ctx context.Context) error                    { return nil }
+func (s *countingSink) Checkpoint(ctx context.Context, pos position) error { return nil }
+func (s *countingSink) Close() error                                       { return nil }
+
+func TestFanoutRetriesOnlyFailedSinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		fails   []int // failures per sink before it accepts the batch
+		retries int
+		want    []int // batches applied per sink
+	}{
+		{"all succeed", []int{0, 0, 0}, 0, []int{1, 1, 1}},
+		{"last fails once", []int{0, 0, 1}, 1, []int{1, 1, 1}},
+		{"middle fails twice", []int{0, 2, 0}, 2, []int{1, 1, 1}},
+		{"first fails once", []int{1, 0, 0}, 1, []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fanoutSink{done: make(map[batchKey][]bool)}
+			var sinks []*countingSink
+			for i, n := range tt.fails {
+				s := &countingSink{fails: n}
+				sinks = append(sinks, s)
+				f.names = append(f.names, string(rune('a'+i)))
+				f.sinks = append(f.sinks, s)
+			}
+			batch := []changeEvent{{Topic: "t", Offset: 7}, {Topic: "t", Offset: 8}}
+			retries := 0
+			for f.Apply(context.Background(), batch) != nil {
+				retries++
+				if retries > 10 {
+					t.Fatal("batch never applied")
+				}
+			}
+			if retries != tt.retries {
+				t.Errorf("retries = %d, want %d", retries, tt.retries)
+			}
+			for i, s := range sinks {
+				if s.applied != tt.want[i] {
+					t.Errorf("sink %d applied %d times, want %d", i, s.applied, tt.want[i])
+				}
+			}
+			if len(f.done) != 0 {
+				t.Errorf("progress left behind for %d batches", len(f.done))
+			}
+		})
+	}
+}
+
+func TestSinkCheckpoints(t *testing.T) {
+	fixed := func(off int64, ok bool) checkpointReader {
+		return func(ctx context.Context, topic string) (position, bool, error) {
+			return position{Topic: topic, Offset: off}, ok, nil
+		}
+	}
+	saved := checkpointReaders
+	defer func() { checkpointReaders = saved }()
+	checkpointReaders = map[string]checkpointReader{
+		"a":     fixed(10, true),
+		"b":     fixed(4, true),
+		"fresh": fixed(0, false),
+	}
+	tests := []struct {
+		name    string
+		sinks   []string
+		want    int64
+		wantOK  bool
+		wantErr error
+	}{
+		{"single sink", []string{"a"}, 10, true, nil},
+		{"lowest of several", []string{"a", "b"}, 4, true, nil},
+		{"sink without readers ignored", []string{"webhook", "a"}, 10, true, nil},
+		{"one sink not checkpointed yet", []string{"a", "fresh"}, 0, false, nil},
+		{"no persisting sink", []string{"webhook"}, 0, false, errNoCheckpoints},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos, ok, err := sinkCheckpoints(tt.sinks)(context.Background(), "topic")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || ok && pos.Offset != tt.want {
+				t.Errorf("got (%d, %v), want (%d, %v)", pos.Offset, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// sink_webhook_test.go — Tests for webhook rule matching and signed delivery.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestWebhookRuleMatches(t *testing.T) {
+	before := map[string]interface{}{"id": float64(1000000), "status": "OK"}
+	after := map[string]interface{}{"id": float64(1000000), "status": "Critical"}
+	same := map[string]interface{}{"id": float64(1000000), "status": "OK", "notes": "x"}
+
+	tests := []struct {
+		name string
+		rule webhookRule
+		e    changeEvent
+		want bool
+	}{
+		{"table only", webhookRule{Table: "alerts"}, changeEvent{Table: "alerts", Op: "c", After: after}, true},
+		{"other table", webhookRule{Table: "devices"}, changeEvent{Table: "alerts", Op: "c", After: after}, false},
+		{"op listed", webhookRule{Table: "alerts", Ops: []string{"c", "u"}}, changeEvent{Table: "alerts", Op: "u", Before: before, After: after}, true},
+		{"op not listed", webhookRule{Table: "alerts", Ops: []string{"c"}}, changeEvent{Table: "alerts", Op: "d", Before: before}, false},
+		{"equals", webhookRule{Table: "alerts", Column: "status", Equals: "Critical"}, changeEvent{Table: "alerts", Op: "c", After: after}, true},
+		{"equals other value", webhookRule{Table: "alerts", Column: "status", Equals: "Critical"}, changeEvent{Table: "alerts", Op: "c", After: before}, false},
+		{"equals large number", webhookRule{Table: "alerts", Column: "id", Equals: "1000000"}, changeEvent{Table: "alerts", Op: "c", After: after}, true},
+		{"equals on delete uses before", webhookRule{Table: "alerts", Column: "status", Equals: "OK"}, changeEvent{Table: "alerts", Op: "d", Before: before}, true},
+		{"changed", webhookRule{Table: "alerts", Column: "status", Changed: true}, changeEvent{Table: "alerts", Op: "u", Before: before, After: after}, true},
+		{"unchanged", webhookRule{Table: "alerts", Column: "status", Changed: true}, changeEvent{Table: "alerts", Op: "u", Before: before, After: same}, false},
+		{"changed without before image", webhookRule{Table: "alerts", Column: "status", Changed: true}, changeEvent{Table: "alerts", Op: "u", After: same}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.e); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// webhookRequest is one request received by the test server.
+type webhookRequest struct {
+	body      []byte
+	timestamp string
+	signature string
+}
+
+func TestWebhookDeliverySignedWithCatalogKey(t *testing.T) {
+	var mu sync.Mutex
+	var got []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, webhookRequest{body, r.Header.Get("X-CDC-Timestamp"), r.Header.Get("X-CDC-Signature")})
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		secret  string
+		key     []string
+		after   map[string]interface{}
+		wantKey interface{}
+	}{
+		{"single key", "s3cret", []string{"serial"},
+			map[string]interface{}{"serial": "SN-1", "status": "Critical"}, "SN-1"},
+		{"composite key with site", "s3cret", []string{siteColumn, "tenant", "id"},
+			map[string]interface{}{siteColumn: "site2", "tenant": "a", "id": float64(7), "status": "Critical"},
+			[]interface{}{"site2", "a", float64(7)}},
+		{"unsigned", "", []string{"id"},
+			map[string]interface{}{"id": float64(1000000), "status": "Critical"}, float64(1000000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			sink, _ := newWebhookSink([]webhookEndpoint{{Name: "test", URL: srv.URL, Secret: tt.secret,
+				Rules: []webhookRule{{Table: "alerts", Column: "status", Equals: "Critical"}}}})
+			defer sink.Close()
+			batch := []changeEvent{
+				{Table: "alerts", Op: "c", Key: tt.key, After: tt.after, Topic: "webhook_test", Offset: 1},
+				{Table: "alerts", Op: "c", Key: tt.key, After: map[string]interface{}{"status": "OK"}, Topic: "webhook_test", Offset: 2},
+			}
+			if err := sink.Apply(context.Background(), batch); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("received %d requests, want 1", len(got))
+			}
+			req := got[0]
+			var payload []map[string]interface{}
+			if err := json.Unmarshal(req.body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if len(payload) != 1 {
+				t.Fatalf("payload has %d events, want the 1 matching", len(payload))
+			}
+			if !reflect.DeepEqual(payload[0]["key"], tt.wantKey) {
+				t.Errorf("key = %#v, want %#v", payload[0]["key"], tt.wantKey)
+			}
+
+			want := ""
+			if tt.secret != "" {
+				m := hmac.New(sha256.New, []byte(tt.secret))
+				m.Write([]byte(req.timestamp + "."))
+				m.Write(req.body)
+				want = "sha256=" + hex.EncodeToString(m.Sum(nil))
+			}
+			if req.signature != want {
+				t.Errorf("signature = %q, want %q", req.signature, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// sources.go — Multi-source federation: several OME instances, one target.
+// Every source has its own slot, connector and topic prefix (see sources in
+// config.go). When more than one source is configured, target rows are
+// namespaced by siteColumn: it is added to every table and prepended to its
+// primary key, unique constraints and foreign keys, so identical SERIAL ids
+// from different sites never collide in the sinks' ON CONFLICT upserts.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dsn returns the connection string of the source database.
+func (s source) dsn() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", s.User, s.Password, s.Host, s.Port, s.DB)
+}
+
+// topic returns the Debezium topic carrying a table of this source.
+func (s source) topic(table string) string {
+	return s.TopicPrefix + ".public." + table
+}
+
+// tableList returns the tables replicated from the source.
+func (s source) tableList() []string {
+	if s.Tables == nil {
+		return tables
+	}
+	return s.Tables
+}
+
+// multiSource reports whether target rows are namespaced by site.
+func multiSource() bool {
+	return len(sources) > 1
+}
+
+// sourceFor returns the source with the given site id, or the first source.
+func sourceFor(site string) source {
+	for _, s := range sources {
+		if s.Site == site {
+			return s
+		}
+	}
+	return sources[0]
+}
+
+// ═══════════════════════════════════════════════════════════════
+// BOOTSTRAP: NAMESPACE KEYS ON THE TARGET
+// ═══════════════════════════════════════════════════════════════
+
+// keyConstraint is a primary key, unique or foreign key constraint on a
+// replicated table.
+type keyConstraint struct {
+	Name     string
+	Type     string // p, u or f
+	Table    string
+	Columns  []string
+	RefTable string
+	RefCols  []string
+	OnDelete string
+	OnUpdate string
+}
+
+// fkActions maps pg_constraint.confdeltype/confupdtype to SQL.
+var fkActions = map[string]string{"a": "NO ACTION", "r": "RESTRICT", "c": "CASCADE", "n": "SET NULL", "d": "SET DEFAULT"}
+
+// namespaceKeys adds siteColumn to every restored table on the target,
+// fills it with the bootstrap site, and rebuilds primary keys, unique
+// constraints and foreign keys with the site as leading column. It is a
+// no-op with a single source. Call after pg_restore and before the filters,
+// mapping and consumers touch the target.
+func namespaceKeys(ctx context.Context, dsn, site string) {
+	if !multiSource() {
+		return
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("  [sources] %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.conname, c.contype, cl.relname, COALESCE(rf.relname, ''),
+		       ARRAY(SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(n, i)
+		             JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.n ORDER BY k.i)::text[],
+		       ARRAY(SELECT a.attname FROM unnest(c.confkey) WITH ORDINALITY k(n, i)
+		             JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.n ORDER BY k.i)::text[],
+		       c.confdeltype, c.confupdtype
+		FROM pg_constraint c
+		JOIN pg_class cl ON cl.oid = c.conrelid
+		LEFT JOIN pg_class rf ON rf.oid = c.confrelid
+		WHERE c.connamespace = 'public'::regnamespace AND c.contype IN ('p', 'u', 'f')
+		  AND cl.relname = ANY($1)`, pq.Array(tables))
+	if err != nil {
+		log.Fatalf("  [sources] constraints: %v", err)
+	}
+	var cons []keyConstraint
+	for rows.Next() {
+		var c keyConstraint
+		if err := rows.Scan(&c.Name, &c.Type, &c.Table, &c.RefTable,
+			pq.Array(&c.Columns), pq.Array(&c.RefCols), &c.OnDelete, &c.OnUpdate); err != nil {
+			log.Fatalf("  [sources] constraints: %v", err)
+		}
+		if !contains(c.Columns, siteColumn) {
+			cons = append(cons, c)
+		}
+	}
+	rows.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Fatalf("  [sources] %v", err)
+	}
+	defer tx.Rollback()
+	exec := func(q string) {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			log.Fatalf("  [sources] %s: %v", q, err)
+		}
+	}
+
+	lit := "'" + strings.ReplaceAll(site, "'", "''") + "'"
+	for _, t := range tables {
+		exec(fmt.Sprintf("ALTER TABLE public.%s ADD COLUMN IF NOT EXISTS %s text NOT NULL DEFAULT %s",
+			quoteIdent(t), quoteIdent(siteColumn), lit))
+		exec(fmt.Sprintf("ALTER TABLE public.%s ALTER COLUMN %s DROP DEFAULT", quoteIdent(t), quoteIdent(siteColumn)))
+	}
+
+	// Foreign keys depend on the referenced keys: drop them first, recreate last.
+	for _, pass := range []string{"f", "pu"} {
+		for _, c := range cons {
+			if strings.Contains(pass, c.Type) {
+				exec(fmt.Sprintf("ALTER TABLE public.%s DROP CONSTRAINT %s", quoteIdent(c.Table), quoteIdent(c.Name)))
+			}
+		}
+	}
+	for _, pass := range []string{"pu", "f"} {
+		for _, c := range cons {
+			if !strings.Contains(pass, c.Type) {
+				continue
+			}
+			cols := quoteIdents(append([]string{siteColumn}, c.Columns...))
+			var def string
+			switch c.Type {
+			case "p":
+				def = "PRIMARY KEY (" + cols + ")"
+			case "u":
+				def = "UNIQUE (" + cols + ")"
+			case "f":
+				onDelete := fkActions[c.OnDelete]
+				if onDelete == "SET NULL" || onDelete == "SET DEFAULT" {
+					// Limit the action to the original columns: the site must stay set.
+					onDelete += " (" + quoteIdents(c.Columns) + ")"
+				}
+				def = fmt.Sprintf("FOREIGN KEY (%s) REFERENCES public.%s (%s) ON DELETE %s ON UPDATE %s",
+					cols, quoteIdent(c.RefTable), quoteIdents(append([]string{siteColumn}, c.RefCols...)),
+					onDelete, fkActions[c.OnUpdate])
+			}
+			exec(fmt.Sprintf("ALTER TABLE public.%s ADD CONSTRAINT %s %s", quoteIdent(c.Table), quoteIdent(c.Name), def))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("  [sources] commit: %v", err)
+	}
+	log.Printf("  [sources] %d tables namespaced by %s (bootstrap site %s), %d constraints rebuilt",
+		len(tables), siteColumn, site, len(cons))
+}
+
+// ═══════════════════════════════════════════════════════════════
+// BOOTSTRAP: SNAPSHOT-COPY ADDITIONAL SOURCES
+// ═══════════════════════════════════════════════════════════════
+
+// snapshotSource copies every table of a source into its sinks as "r"
+// events, reading all tables in one REPEATABLE READ snapshot taken after the
+// source's slot was created. Changes committed between slot creation and the
+// snapshot are replayed by the connector later; upserts make that harmless.
+// Tables are copied in FK order (parents first) so foreign keys hold. When
+// ctx is cancelled mid-copy the remaining tables are skipped.
+func snapshotSource(ctx context.Context, src source, order []string) {
+	db, err := sql.Open("postgres", src.dsn())
+	if err != nil {
+		log.Fatalf("  [sources] %s: %v", src.Site, err)
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Fatalf("  [sources] %s: %v", src.Site, err)
+	}
+	defer tx.Rollback()
+
+	for _, t := range order {
+		n, err := snapshotTable(ctx, tx, src, t)
+		if err != nil && ctx.Err() != nil {
+			log.Printf("  [sources] %s.%s: interrupted after %d rows", src.Site, t, n)
+			return // the caller's checkAborted ends the bootstrap
+		}
+		if err != nil {
+			log.Fatalf("  [sources] %s.%s: %v", src.Site, t, err)
+		}
+		log.Printf("  [sources] %s.%s: %d rows", src.Site, t, n)
+	}
+}
+
+// snapshotTable streams one table through filter, masking, mapping and the
+// table's sink in batches of batchSize. A batch abandoned because ctx was
+// cancelled ends the snapshot with an error, so it never counts as done.
+func snapshotTable(ctx context.Context, tx *sql.Tx, src source, table string) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM public.%s ORDER BY 1", quoteIdent(table)))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	sink := sinkFor(table)
+	var batch []changeEvent
+	n := 0
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				row[c] = string(b) // text, numeric, json, inet: same shape as Debezium's strings
+			} else {
+				row[c] = vals[i]
+			}
+		}
+		n++
+		e := changeEvent{Table: table, Site: src.Site, Op: "r", After: row, Topic: src.topic(table)}
+		e, ok, err := filterEvent(ctx, e)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			batch = append(batch, mapEvent(maskEvent(e)))
+		}
+		if len(batch) >= batchSize {
+			if !applyEvents(ctx, sink, table, batch) {
+				return n, fmt.Errorf("batch not applied: %w", ctx.Err())
+			}
+			batch = nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if len(batch) > 0 && !applyEvents(ctx, sink, table, batch) {
+		return n, fmt.Errorf("batch not applied: %w", ctx.Err())
+	}
+	return n, nil
+}
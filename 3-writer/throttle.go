@@ -0,0 +1,186 @@
+// throttle.go — Rate limiting and adaptive backpressure toward postgres2.
+// Consumers call throttle.admit after every Kafka fetch. It blocks on the
+// global and per-table token buckets and then for the adaptive delay, so a
+// throttled consumer simply fetches less often: writes are slowed, never
+// failed, and the backlog waits in Kafka.
+//
+// The adaptive delay is AIMD on fetch rate, kept per table and driven by the
+// postgres2 sink: a batch of the table slower than applyLatencyTarget, or a
+// failed one, doubles its delay (multiplicative decrease of rate); every
+// healthy batch shortens it by backoffStep (additive increase) until it is
+// gone. Batches waiting for a referenced row (errFKWait) are expected retries
+// and do not count.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttle is the process-wide limiter shared by all consumers.
+var throttle = newThrottler(globalRateLimit)
+
+// throttler combines the token buckets with the adaptive delay.
+type throttler struct {
+	global *tokenBucket // nil = unlimited
+
+	mu      sync.Mutex
+	tables  map[string]*tokenBucket
+	delays  map[string]time.Duration // table → current adaptive delay per fetch
+	latency time.Duration            // EWMA of postgres2 batch apply time
+	errors  int64                    // failed postgres2 batches
+	waited  time.Duration            // total time consumers spent throttled
+}
+
+func newThrottler(globalRate float64) *throttler {
+	t := &throttler{tables: make(map[string]*tokenBucket), delays: make(map[string]time.Duration)}
+	if globalRate > 0 {
+		t.global = newTokenBucket(globalRate)
+	}
+	return t
+}
+
+// admit blocks until n fetched events of table may proceed.
+func (t *throttler) admit(ctx context.Context, table string, n int) {
+	start := time.Now()
+	if t.global != nil {
+		t.global.take(ctx, n)
+	}
+	if b := t.bucket(table); b != nil {
+		b.take(ctx, n)
+	}
+	t.mu.Lock()
+	d := t.delays[table]
+	t.mu.Unlock()
+	if d > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+	}
+	if w := time.Since(start); w > time.Millisecond {
+		t.mu.Lock()
+		t.waited += w
+		t.mu.Unlock()
+	}
+}
+
+// bucket returns the table's token bucket, nil when it has no RateLimit.
+func (t *throttler) bucket(table string) *tokenBucket {
+	rate := configFor(table).RateLimit
+	if rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.tables[table]
+	if !ok {
+		b = newTokenBucket(rate)
+		t.tables[table] = b
+	}
+	return b
+}
+
+// observe feeds one postgres2 batch apply of table into its adaptive delay.
+// Foreign-key waits and cancelled applies say nothing about postgres2's load
+// and are ignored.
+func (t *throttler) observe(table string, d time.Duration, err error) {
+	if errors.Is(err, errFKWait) || errors.Is(err, context.Canceled) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latency == 0 {
+		t.latency = d
+	} else {
+		t.latency = (t.latency*4 + d) / 5
+	}
+	prev := t.delays[table]
+	delay := max(prev-backoffStep, 0)
+	if err != nil || d > applyLatencyTarget {
+		if err != nil {
+			t.errors++
+		}
+		delay = min(max(prev*2, backoffStep), backoffMax)
+	}
+	if delay > 0 {
+		t.delays[table] = delay
+	} else {
+		delete(t.delays, table)
+	}
+	if (prev == 0) != (delay == 0) {
+		if delay > 0 {
+			log.Printf("  [throttle] %s backing off: postgres2 apply %v (target %v), err=%v", table, d, applyLatencyTarget, err)
+		} else {
+			log.Printf("  [throttle] %s: postgres2 healthy, backoff cleared", table)
+		}
+	}
+}
+
+// status renders the throttle state for the status log.
+func (t *throttler) status() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := []string{fmt.Sprintf("apply=%v errors=%d waited=%v",
+		t.latency.Round(time.Millisecond), t.errors, t.waited.Round(time.Second))}
+	var delayed []string
+	for name := range t.delays {
+		delayed = append(delayed, name)
+	}
+	sort.Strings(delayed)
+	for _, name := range delayed {
+		parts = append(parts, fmt.Sprintf("%s delay=%v", name, t.delays[name]))
+	}
+	if t.global != nil {
+		parts = append(parts, fmt.Sprintf("global=%.0f/s", t.global.rate))
+	}
+	var names []string
+	for name := range t.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%.0f/s", name, t.tables[name].rate))
+	}
+	return strings.Join(parts, " ")
+}
+
+// tokenBucket is a rate limiter in events per second with one second of
+// burst. A take larger than the bucket runs it into debt, which later takes
+// wait off, so whole batches can be admitted at once.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take withdraws n tokens and sleeps until the balance is no longer negative.
+func (b *tokenBucket) take(ctx context.Context, n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// throttle_test.go — Tests for the token buckets and the adaptive delay.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestThrottleObserve(t *testing.T) {
+	slow := applyLatencyTarget + time.Millisecond
+	fast := applyLatencyTarget / 2
+	failed := errors.New("connection reset")
+	fkWait := fmt.Errorf("upsert 7: %w: %w", errFKWait, errors.New("violates foreign key"))
+
+	type step struct {
+		d   time.Duration
+		err error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  time.Duration
+	}{
+		{"healthy", []step{{fast, nil}}, 0},
+		{"slow batch", []step{{slow, nil}}, backoffStep},
+		{"failures double", []step{{fast, failed}, {fast, failed}, {fast, failed}}, 4 * backoffStep},
+		{"healthy batches step down", []step{{slow, nil}, {slow, nil}, {fast, nil}}, backoffStep},
+		{"capped", []step{{slow, nil}, {slow, nil}, {slow, nil}, {slow, nil}, {slow, nil}, {slow, nil}, {slow, nil}, {slow, nil}}, backoffMax},
+		{"foreign-key waits ignored", []step{{fast, fkWait}, {fast, fkWait}}, 0},
+		{"foreign-key waits keep the delay", []step{{slow, nil}, {fast, fkWait}}, backoffStep},
+		{"cancellation ignored", []step{{fast, context.Canceled}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := newThrottler(0)
+			for _, s := range tt.steps {
+				th.observe("a", s.d, s.err)
+			}
+			if got := th.delays["a"]; got != tt.want {
+				t.Errorf("delay = %v, want %v", got, tt.want)
+			}
+			if got := th.delays["b"]; got != 0 {
+				t.Errorf("other table delayed by %v", got)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name  string
+		rate  float64
+		takes []int
+		want  float64 // balance after the takes
+	}{
+		{"within burst", 100, []int{30, 20}, 50},
+		{"whole burst", 100, []int{100}, 0},
+		{"batch larger than burst runs into debt", 100, []int{250}, -150},
+		{"debt accumulates", 100, []int{80, 80}, -60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate)
+			for _, n := range tt.takes {
+				b.take(cancelled, n)
+			}
+			// Refill between takes is at most a few tokens.
+			if math.Abs(b.tokens-tt.want) > 1 {
+				t.Errorf("tokens = %.2f, want %.0f", b.tokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketWaitsOffDebt(t *testing.T) {
+	b := newTokenBucket(1000)
+	start := time.Now()
+	b.take(context.Background(), 1050)
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Errorf("take waited %v, want about 50ms", d)
+	}
+}
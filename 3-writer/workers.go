@@ -0,0 +1,131 @@
+// workers.go — Per-table worker pool for parallel, key-partitioned apply.
+// Each prepared batch is split by a hash of the event's target key into one
+// sub-batch per worker. All changes of a key land on the same worker, in
+// source order, so per-key ordering holds while different keys are written
+// in parallel. Workers run ahead of each other; the checkpoint only moves to
+// the end of a batch once every batch up to it is fully applied (the low
+// watermark), so a restart never skips an unapplied event.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+// workerPool applies one table's batches on N key-partitioned workers.
+type workerPool struct {
+	sink    Sink
+	table   string
+	workers []chan workItem
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*batchProgress // submitted batches not yet checkpointed, in order
+}
+
+// workItem is one worker's share of a batch.
+type workItem struct {
+	events   []changeEvent
+	progress *batchProgress
+}
+
+// batchProgress counts the workers still applying a batch.
+type batchProgress struct {
+	pos       position
+	remaining int
+}
+
+// newWorkerPool starts n workers for a table. Each worker buffers one batch
+// ahead, which bounds how far the reader can outrun the slowest worker.
+func newWorkerPool(ctx context.Context, sink Sink, table string, n int) *workerPool {
+	p := &workerPool{sink: sink, table: table, workers: make([]chan workItem, n)}
+	for i := range p.workers {
+		ch := make(chan workItem, 1)
+		p.workers[i] = ch
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for item := range ch {
+				// An abandoned share keeps its batch, and every later one,
+				// below the watermark.
+				if applyEvents(ctx, sink, table, item.events) {
+					p.done(ctx, item.progress)
+				}
+			}
+		}()
+	}
+	log.Printf("  [workers] %s: %d workers", table, n)
+	return p
+}
+
+// submit partitions a prepared batch across the workers. It blocks while a
+// target worker is still busy with its previous share.
+func (p *workerPool) submit(ctx context.Context, batch []changeEvent, pos position) {
+	parts := make([][]changeEvent, len(p.workers))
+	for _, e := range batch {
+		i := partitionOf(e, len(p.workers))
+		parts[i] = append(parts[i], e)
+	}
+	prog := &batchProgress{pos: pos}
+	for _, part := range parts {
+		if len(part) > 0 {
+			prog.remaining++
+		}
+	}
+	p.mu.Lock()
+	p.pending = append(p.pending, prog)
+	p.mu.Unlock()
+	if prog.remaining == 0 {
+		p.done(ctx, nil) // filtered-out batch: only the watermark moves
+		return
+	}
+	for i, part := range parts {
+		if len(part) > 0 {
+			p.workers[i] <- workItem{events: part, progress: prog}
+		}
+	}
+}
+
+// done marks one worker's share of a batch applied (nil: nothing to mark)
+// and checkpoints the newest position below which every batch is complete.
+func (p *workerPool) done(ctx context.Context, prog *batchProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if prog != nil {
+		prog.remaining--
+	}
+	var low *position
+	for len(p.pending) > 0 && p.pending[0].remaining == 0 {
+		low = &p.pending[0].pos
+		p.pending = p.pending[1:]
+	}
+	if low == nil {
+		return
+	}
+	// Checkpointing under the lock keeps checkpoints in order.
+	if err := p.sink.Checkpoint(ctx, *low); err != nil {
+		log.Printf("  [workers] %s checkpoint: %v", p.table, err)
+		return
+	}
+	noteApplied(low.Topic, low.Offset)
+}
+
+// close stops accepting batches and waits until the workers have drained
+// what was submitted.
+func (p *workerPool) close() {
+	for _, ch := range p.workers {
+		close(ch)
+	}
+	p.wg.Wait()
+}
+
+// partitionOf hashes an event's target key to a worker index.
+func partitionOf(e changeEvent, n int) int {
+	b, _ := json.Marshal(keyValues(e.Key, e.row()))
+	h := fnv.New32a()
+	h.Write(b)
+	return int(h.Sum32() % uint32(n))
+}
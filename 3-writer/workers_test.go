@@ -0,0 +1,121 @@
+// workers_test.go — Tests for the worker pool's partitioning and low watermark.
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingSink records applied events and checkpoints.
+type recordingSink struct {
+	mu          sync.Mutex
+	events      []changeEvent
+	checkpoints []int64
+}
+
+func (s *recordingSink) Apply(ctx context.Context, batch []changeEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, batch...)
+	return nil
+}
+func (s *recordingSink) Flush(ctx context.Context) error { return nil }
+func (s *recordingSink) Checkpoint(ctx context.Context, pos position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints = append(s.checkpoints, pos.Offset)
+	return nil
+}
+func (s *recordingSink) Close() error { return nil }
+
+func TestWorkerPoolLowWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining []int   // worker shares per pending batch, offsets 1, 2, ...
+		finish    []int   // batch index whose next share completes, in order
+		want      []int64 // checkpoints written
+	}{
+		{"in order", []int{1, 1, 1}, []int{0, 1, 2}, []int64{1, 2, 3}},
+		{"later batch first", []int{1, 1, 1}, []int{2, 1, 0}, []int64{3}},
+		{"middle first", []int{1, 1, 1}, []int{1, 0, 2}, []int64{2, 3}},
+		{"split batch waits for every share", []int{2, 1}, []int{0, 1, 0}, []int64{2}},
+		{"head unfinished", []int{2, 1}, []int{1, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			p := &workerPool{sink: sink, table: "t"}
+			var progs []*batchProgress
+			for i, n := range tt.remaining {
+				prog := &batchProgress{pos: position{Topic: "workers_test", Offset: int64(i + 1)}, remaining: n}
+				progs = append(progs, prog)
+				p.pending = append(p.pending, prog)
+			}
+			for _, i := range tt.finish {
+				p.done(context.Background(), progs[i])
+			}
+			if !reflect.DeepEqual(sink.checkpoints, tt.want) {
+				t.Errorf("checkpoints = %v, want %v", sink.checkpoints, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolKeepsKeyOrder(t *testing.T) {
+	sink := &recordingSink{}
+	p := newWorkerPool(context.Background(), sink, "t", 4)
+	var last int64
+	for b := 0; b < 20; b++ {
+		var batch []changeEvent
+		for k := 0; k < 8; k++ {
+			last++
+			batch = append(batch, changeEvent{Op: "u", Key: []string{"id"}, Offset: last,
+				After: map[string]interface{}{"id": float64(k)}})
+		}
+		p.submit(context.Background(), batch, position{Topic: "workers_test", Offset: last})
+	}
+	p.submit(context.Background(), nil, position{Topic: "workers_test", Offset: last + 1})
+	p.close()
+
+	if len(sink.events) != int(last) {
+		t.Fatalf("applied %d events, want %d", len(sink.events), last)
+	}
+	seen := make(map[interface{}]int64)
+	for _, e := range sink.events {
+		id := e.After["id"]
+		if e.Offset <= seen[id] {
+			t.Fatalf("key %v: offset %d applied after %d", id, e.Offset, seen[id])
+		}
+		seen[id] = e.Offset
+	}
+	if n := len(sink.checkpoints); n == 0 || sink.checkpoints[n-1] != last+1 {
+		t.Errorf("last checkpoint = %v, want %d", sink.checkpoints, last+1)
+	}
+	for i := 1; i < len(sink.checkpoints); i++ {
+		if sink.checkpoints[i] <= sink.checkpoints[i-1] {
+			t.Errorf("checkpoints out of order: %v", sink.checkpoints)
+		}
+	}
+}
+
+func TestPartitionOf(t *testing.T) {
+	row := map[string]interface{}{"tenant": "a", "id": float64(7)}
+	tests := []struct {
+		name string
+		a, b changeEvent
+	}{
+		{"update and delete of a key", changeEvent{Op: "u", Key: []string{"id"}, After: row},
+			changeEvent{Op: "d", Key: []string{"id"}, Before: row}},
+		{"composite key", changeEvent{Op: "c", Key: []string{"tenant", "id"}, After: row},
+			changeEvent{Op: "u", Key: []string{"tenant", "id"}, After: map[string]interface{}{"tenant": "a", "id": float64(7), "x": 1}}},
+	}
+	for _, tt := range tests {
+		for _, n := range []int{1, 3, 8} {
+			if a, b := partitionOf(tt.a, n), partitionOf(tt.b, n); a != b || a < 0 || a >= n {
+				t.Errorf("%s, %d workers: partitions %d and %d", tt.name, n, a, b)
+			}
+		}
+	}
+}